@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"pipeline"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// journalSuffix is appended to the path of a file to name its resume journal.
+	journalSuffix = ".granger"
+)
+
+// BatchEntry is a single file to download in a batch.
+type BatchEntry struct {
+	URL string `json:"url"`
+	// Dest is where to save the file, relative to BatchConfig.Dir. It may not be absolute or lead out of the directory.
+	// If it is empty, the last element of the URL's path is used.
+	Dest string `json:"dest,omitempty"`
+	// SHA256 is the expected SHA-256 of the file in hex, if known.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// ParseManifest reads the files to download in a batch. A manifest is either a JSON array of entries, or a list of
+// URLs with one per line, in which case blank lines and lines starting with # are ignored.
+func ParseManifest(r io.Reader) ([]BatchEntry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var entries []BatchEntry
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, fmt.Errorf("invalid manifest: %w", err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, BatchEntry{URL: line})
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, entry := range entries {
+		if entry.URL == "" {
+			return nil, fmt.Errorf("invalid manifest: entry %v has no url", i)
+		}
+	}
+	return entries, nil
+}
+
+// BatchConfig controls how a batch is downloaded.
+type BatchConfig struct {
+	// Concurrency is how many fragments may be fetched at once across every file in the batch. Defaults to 1.
+	Concurrency int
+	// BytesPerSecond limits the combined bandwidth of every file in the batch. Zero means unlimited.
+	BytesPerSecond int64
+	// Dir is the directory that destinations are saved under. Defaults to the working directory.
+	Dir string
+	// Resume keeps a resume journal next to each file, so that a batch which is interrupted can be run again
+	// without fetching the files it had already finished.
+	Resume bool
+	// Options are applied to the download of every file.
+	Options []Option
+}
+
+// BatchResult is the outcome of downloading a single file of a batch.
+type BatchResult struct {
+	URL     string  `json:"url"`
+	Dest    string  `json:"dest"`
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// BatchSummary describes how a batch went, and is meant to be written out as JSON.
+type BatchSummary struct {
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Bytes     int64         `json:"bytes"`
+	Seconds   float64       `json:"seconds"`
+	Results   []BatchResult `json:"results"`
+}
+
+// DownloadBatch downloads every entry, sharing the concurrency and bandwidth in config between them. A file which
+// fails doesn't stop the others, so the summary has to be checked for failures. If ctx is cancelled, the files which
+// haven't finished fail.
+func DownloadBatch(ctx context.Context, entries []BatchEntry, config BatchConfig) *BatchSummary {
+	start := time.Now()
+	concurrency := max(config.Concurrency, 1)
+	shared := []Option{
+		WithParallelization(concurrency),
+		withFetchSlots(pipeline.NewSemaphore(concurrency)),
+	}
+	if config.BytesPerSecond > 0 {
+		shared = append(shared, WithRateLimiter(NewRateLimiter(config.BytesPerSecond)))
+	}
+
+	summary := &BatchSummary{Results: make([]BatchResult, len(entries))}
+	dests, errs := resolveDests(entries, config.Dir)
+	// Fragments are limited by the shared slots, but there's no point starting more files than can be fetched.
+	files := pipeline.NewSemaphore(concurrency)
+	wg := sync.WaitGroup{}
+	for i, entry := range entries {
+		if errs[i] != nil {
+			summary.Results[i] = BatchResult{URL: entry.URL, Dest: dests[i], Error: errs[i].Error()}
+			continue
+		}
+		files.Acquire()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer files.Release()
+			summary.Results[i] = downloadEntry(ctx, entry, dests[i], config, shared)
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range summary.Results {
+		if result.Error == "" {
+			summary.Succeeded += 1
+		} else {
+			summary.Failed += 1
+		}
+		summary.Bytes += result.Bytes
+	}
+	summary.Seconds = time.Since(start).Seconds()
+	return summary
+}
+
+// resolveDests works out where each entry is saved. An entry fails if its dest can't be worked out, or if another
+// entry is saved to the same place, as they would overwrite each other.
+func resolveDests(entries []BatchEntry, dir string) ([]string, []error) {
+	dests := make([]string, len(entries))
+	errs := make([]error, len(entries))
+	byDest := map[string][]int{}
+	for i, entry := range entries {
+		dests[i], errs[i] = resolveDest(entry, dir)
+		if errs[i] == nil {
+			dest := filepath.Clean(dests[i])
+			byDest[dest] = append(byDest[dest], i)
+		}
+	}
+	for dest, shared := range byDest {
+		if len(shared) > 1 {
+			for _, i := range shared {
+				errs[i] = fmt.Errorf("dest %v is shared by %v entries", dest, len(shared))
+			}
+		}
+	}
+	return dests, errs
+}
+
+// resolveDest returns where entry is saved, which is always inside dir.
+func resolveDest(entry BatchEntry, dir string) (string, error) {
+	dest := entry.Dest
+	if dest == "" {
+		u, err := url.Parse(entry.URL)
+		if err != nil {
+			return "", err
+		}
+		if dest = path.Base(u.Path); dest == "/" || dest == "." {
+			return "", errors.New("no dest given, and the url has no file name")
+		}
+	}
+	// A manifest mustn't be able to write anywhere it likes, such as over ../../etc/passwd.
+	if !filepath.IsLocal(dest) {
+		return "", fmt.Errorf("dest %v is outside of the directory", dest)
+	}
+	return filepath.Join(dir, dest), nil
+}
+
+// downloadEntry downloads a single entry of a batch to dest.
+func downloadEntry(ctx context.Context, entry BatchEntry, dest string, config BatchConfig,
+	shared []Option) BatchResult {
+	start := time.Now()
+	result := BatchResult{URL: entry.URL, Dest: dest}
+	n, err := func() (int64, error) {
+		u, err := url.Parse(entry.URL)
+		if err != nil {
+			return 0, err
+		}
+
+		options := append(append([]Option{}, config.Options...), shared...)
+		if entry.SHA256 != "" {
+			sum, err := hex.DecodeString(entry.SHA256)
+			if err != nil || len(sum) != 32 {
+				return 0, fmt.Errorf("invalid sha256 %q", entry.SHA256)
+			}
+			options = append(options, WithExpectedDigest(AlgorithmSHA256, sum))
+		}
+		return downloadFile(ctx, u, result.Dest, config.Resume, options)
+	}()
+
+	result.Bytes = n
+	result.Seconds = time.Since(start).Seconds()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// downloadFile downloads u to dest. Unless it can be resumed, a file which fails is removed.
+func downloadFile(ctx context.Context, u *url.URL, dest string, resume bool, options []Option) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return 0, err
+	}
+	flags := os.O_RDWR | os.O_CREATE
+	if resume {
+		options = append(options, WithResumeJournal(dest+journalSuffix))
+	} else {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(dest, flags, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := NewGranger(u, options...).WriteToContext(ctx, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil && !resume {
+		_ = os.Remove(dest)
+	}
+	return n, err
+}
+
+// withFetchSlots limits how many fragments are fetched at once to the slots of semaphore, which may be shared with
+// other downloads.
+func withFetchSlots(semaphore *pipeline.Semaphore) Option {
+	return func(g *Granger) {
+		g.fetchSlots = semaphore
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFileServer serves each of files at /<name>, counting how many fragments are being fetched at once across all
+// of them. Anything else is a 404.
+func newFileServer(files map[string][]byte, delay time.Duration, inflight, peak *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, ok := files[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if rng := r.Header.Get("Range"); rng != "" && rng != "bytes=0-0" {
+			n := inflight.Add(1)
+			defer inflight.Add(-1)
+			for m := peak.Load(); n > m && !peak.CompareAndSwap(m, n); m = peak.Load() {
+			}
+			time.Sleep(delay)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	}))
+}
+
+func TestParseManifest(t *testing.T) {
+	tests := map[string]struct {
+		manifest string
+		expected []BatchEntry
+		err      string
+	}{
+		"lines": {
+			manifest: "# artifacts\nhttp://example.com/a.bin\n\n  http://example.com/b.bin  \n",
+			expected: []BatchEntry{{URL: "http://example.com/a.bin"}, {URL: "http://example.com/b.bin"}},
+		},
+		"json": {
+			manifest: `[{"url": "http://example.com/a.bin", "dest": "out/a", "sha256": "abcd"}]`,
+			expected: []BatchEntry{{URL: "http://example.com/a.bin", Dest: "out/a", SHA256: "abcd"}},
+		},
+		"empty":             {manifest: "\n"},
+		"invalid json":      {manifest: `[{"url": }]`, err: "invalid manifest"},
+		"entry without url": {manifest: `[{"dest": "a"}]`, err: "has no url"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			entries, err := ParseManifest(strings.NewReader(test.manifest))
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.expected, entries)
+			}
+		})
+	}
+}
+
+func TestDownloadBatch(t *testing.T) {
+	files := map[string][]byte{}
+	for i := 0; i < 4; i++ {
+		files[fmt.Sprintf("file%v.bin", i)] = bytes.Repeat([]byte{byte('a' + i)}, 40)
+	}
+	inflight, maxInflight := &atomic.Int32{}, &atomic.Int32{}
+	server := newFileServer(files, 5*time.Millisecond, inflight, maxInflight)
+	defer server.Close()
+
+	sum := sha256.Sum256(files["file1.bin"])
+	entries := []BatchEntry{
+		{URL: server.URL + "/file0.bin"},
+		{URL: server.URL + "/file1.bin", Dest: "nested/one.bin", SHA256: hex.EncodeToString(sum[:])},
+		{URL: server.URL + "/file2.bin", SHA256: hex.EncodeToString(make([]byte, 32))},
+		{URL: server.URL + "/file3.bin"},
+		{URL: server.URL + "/missing.bin"},
+	}
+	dir := t.TempDir()
+	summary := DownloadBatch(context.Background(), entries, BatchConfig{
+		Concurrency: 3,
+		Dir:         dir,
+		Options:     []Option{WithFragmentSize(8)},
+	})
+
+	assert.Equal(t, 3, summary.Succeeded)
+	assert.Equal(t, 2, summary.Failed)
+	assert.Equal(t, int64(40), summary.Results[0].Bytes)
+	assert.GreaterOrEqual(t, summary.Bytes, int64(3*40))
+	assert.LessOrEqual(t, maxInflight.Load(), int32(3))
+	assert.Greater(t, maxInflight.Load(), int32(1))
+
+	for i, result := range summary.Results {
+		assert.Equal(t, entries[i].URL, result.URL)
+		assert.Greater(t, result.Seconds, 0.0)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "file0.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, files["file0.bin"], data)
+	data, err = os.ReadFile(filepath.Join(dir, "nested", "one.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, files["file1.bin"], data)
+
+	// Files which fail aren't left behind.
+	assert.Contains(t, summary.Results[2].Error, "checksum mismatch")
+	assert.NoFileExists(t, filepath.Join(dir, "file2.bin"))
+	assert.Contains(t, summary.Results[4].Error, "404")
+	assert.NoFileExists(t, filepath.Join(dir, "missing.bin"))
+}
+
+func TestDownloadBatchSharedDest(t *testing.T) {
+	files := map[string][]byte{
+		"v1/app.tar": bytes.Repeat([]byte("1"), 40),
+		"v2/app.tar": bytes.Repeat([]byte("2"), 40),
+		"v2/lib.tar": bytes.Repeat([]byte("3"), 40),
+	}
+	server := newFileServer(files, 0, &atomic.Int32{}, &atomic.Int32{})
+	defer server.Close()
+
+	entries := []BatchEntry{
+		{URL: server.URL + "/v1/app.tar"},
+		{URL: server.URL + "/v2/app.tar"},
+		{URL: server.URL + "/v2/lib.tar"},
+		{URL: server.URL + "/v2/lib.tar", Dest: "./lib.tar"},
+		{URL: server.URL + "/v2/lib.tar", Dest: "other/lib.tar"},
+	}
+	dir := t.TempDir()
+	summary := DownloadBatch(context.Background(), entries, BatchConfig{Concurrency: 2, Dir: dir})
+
+	// Entries which would overwrite each other fail without being downloaded, but the rest go ahead.
+	assert.Equal(t, 1, summary.Succeeded)
+	assert.Equal(t, 4, summary.Failed)
+	for _, i := range []int{0, 1, 2, 3} {
+		assert.Contains(t, summary.Results[i].Error, "shared by 2 entries")
+	}
+	assert.NoFileExists(t, filepath.Join(dir, "app.tar"))
+	assert.NoFileExists(t, filepath.Join(dir, "lib.tar"))
+	data, err := os.ReadFile(filepath.Join(dir, "other", "lib.tar"))
+	assert.NoError(t, err)
+	assert.Equal(t, files["v2/lib.tar"], data)
+}
+
+func TestResolveDest(t *testing.T) {
+	dir := t.TempDir()
+	dest, err := resolveDest(BatchEntry{URL: "http://example.com/a/file.bin"}, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "file.bin"), dest)
+	dest, err = resolveDest(BatchEntry{URL: "http://example.com/file.bin", Dest: "nested/../one.bin"}, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "one.bin"), dest)
+	dest, err = resolveDest(BatchEntry{URL: "http://example.com/file.bin", Dest: "one.bin"}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "one.bin", dest)
+
+	// Dests which lead out of the directory are rejected.
+	for _, escape := range []string{"../../etc/x", "nested/../../x", "/etc/x", ".."} {
+		_, err = resolveDest(BatchEntry{URL: "http://example.com/file.bin", Dest: escape}, dir)
+		assert.ErrorContains(t, err, "outside of the directory", escape)
+		_, err = resolveDest(BatchEntry{URL: "http://example.com/file.bin", Dest: escape}, "")
+		assert.ErrorContains(t, err, "outside of the directory", escape)
+	}
+}
+
+func TestDownloadBatchSharesBandwidth(t *testing.T) {
+	files := map[string][]byte{
+		"a.bin": make([]byte, 150*1024),
+		"b.bin": make([]byte, 150*1024),
+	}
+	server := newFileServer(files, 0, &atomic.Int32{}, &atomic.Int32{})
+	defer server.Close()
+
+	start := time.Now()
+	summary := DownloadBatch(context.Background(), []BatchEntry{
+		{URL: server.URL + "/a.bin"},
+		{URL: server.URL + "/b.bin"},
+	}, BatchConfig{
+		Concurrency:    2,
+		BytesPerSecond: 1024 * 1024,
+		Dir:            t.TempDir(),
+		Options:        []Option{WithFragmentSize(32 * 1024)},
+	})
+	assert.Equal(t, 2, summary.Succeeded)
+	// 300 KiB at 1 MiB/s, less the 100 KiB the limiter starts out with, can't take less than about 200ms.
+	assert.GreaterOrEqual(t, time.Since(start), 180*time.Millisecond)
+}
@@ -0,0 +1,60 @@
+package main
+
+import "container/list"
+
+// blockCache is a least recently used cache of fixed size blocks of the source, keyed by block index. It is not safe
+// for concurrent use.
+type blockCache struct {
+	capacity int
+	order    *list.List
+	blocks   map[int64]*list.Element
+}
+
+type cachedBlock struct {
+	index int64
+	data  []byte
+}
+
+func newBlockCache(capacity int) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		order:    list.New(),
+		blocks:   map[int64]*list.Element{},
+	}
+}
+
+// Get returns the block at index, marking it as the most recently used.
+func (c *blockCache) Get(index int64) ([]byte, bool) {
+	elem, ok := c.blocks[index]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cachedBlock).data, true
+}
+
+// Contains returns true if the block at index is cached, without affecting its recency.
+func (c *blockCache) Contains(index int64) bool {
+	_, ok := c.blocks[index]
+	return ok
+}
+
+// Add caches the block at index, evicting the least recently used blocks if the cache is full.
+func (c *blockCache) Add(index int64, data []byte) {
+	if elem, ok := c.blocks[index]; ok {
+		elem.Value.(*cachedBlock).data = data
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.blocks[index] = c.order.PushFront(&cachedBlock{index: index, data: data})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.blocks, oldest.Value.(*cachedBlock).index)
+	}
+}
+
+// Len returns the number of cached blocks.
+func (c *blockCache) Len() int {
+	return c.order.Len()
+}
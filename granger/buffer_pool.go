@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// fragmentBuffers holds buffers which have been written out, so that later fragments can reuse them rather than
+// allocating new ones.
+var fragmentBuffers = sync.Pool{
+	New: func() any {
+		return &bytes.Buffer{}
+	},
+}
+
+// bufferPool hands out fragment buffers while keeping the total size of the buffers in use under a ceiling. Once
+// the ceiling is reached, Get blocks until a buffer is returned, which happens once its fragment has been written. A
+// slow writer therefore throttles how quickly new fragments are fetched.
+type bufferPool struct {
+	// maxBytes is the most we'll have buffered at once. Zero means there is no limit.
+	maxBytes int64
+
+	mu    sync.Mutex
+	inUse int64
+	// freeCh is closed and replaced whenever a buffer is returned.
+	freeCh chan struct{}
+}
+
+func newBufferPool(maxBytes int64) *bufferPool {
+	return &bufferPool{
+		maxBytes: maxBytes,
+		freeCh:   make(chan struct{}),
+	}
+}
+
+// Get returns an empty buffer with room for size bytes, waiting until that many bytes are free under the ceiling.
+// A single buffer larger than the ceiling is handed out once nothing else is in use, rather than waiting forever.
+func (p *bufferPool) Get(ctx context.Context, size int) (*bytes.Buffer, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		if p.maxBytes == 0 || p.inUse+int64(size) <= p.maxBytes || p.inUse == 0 {
+			p.inUse += int64(size)
+			p.mu.Unlock()
+			break
+		}
+		freeCh := p.freeCh
+		p.mu.Unlock()
+
+		select {
+		case <-freeCh:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return newFragmentBuffer(size), nil
+}
+
+func newFragmentBuffer(size int) *bytes.Buffer {
+	buffer := fragmentBuffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+	buffer.Grow(size)
+	return buffer
+}
+
+// TryGet is like Get, but returns false rather than waiting if there isn't room for size bytes.
+func (p *bufferPool) TryGet(size int) (*bytes.Buffer, bool) {
+	p.mu.Lock()
+	if p.maxBytes != 0 && p.inUse+int64(size) > p.maxBytes && p.inUse != 0 {
+		p.mu.Unlock()
+		return nil, false
+	}
+	p.inUse += int64(size)
+	p.mu.Unlock()
+
+	return newFragmentBuffer(size), true
+}
+
+// Put returns a buffer which was handed out by Get for size bytes.
+func (p *bufferPool) Put(buffer *bytes.Buffer, size int) {
+	fragmentBuffers.Put(buffer)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inUse -= int64(size)
+	close(p.freeCh)
+	p.freeCh = make(chan struct{})
+}
+
+// InUse returns the number of bytes currently handed out.
+func (p *bufferPool) InUse() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inUse
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBufferPoolCeiling(t *testing.T) {
+	pool := newBufferPool(10)
+
+	first, err := pool.Get(context.Background(), 6)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, first.Cap(), 6)
+
+	// There isn't room for another 6 bytes until the first buffer comes back.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = pool.Get(ctx, 6)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	got := make(chan struct{})
+	go func() {
+		second, err := pool.Get(context.Background(), 6)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, second.Len())
+		close(got)
+	}()
+	first.WriteString("abcdef")
+	pool.Put(first, 6)
+	<-got
+	assert.Equal(t, int64(6), pool.InUse())
+}
+
+func TestBufferPoolOversizedBuffer(t *testing.T) {
+	pool := newBufferPool(10)
+
+	// A buffer bigger than the ceiling is allowed when nothing else is in use, otherwise we'd never make progress.
+	buffer, err := pool.Get(context.Background(), 20)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), pool.InUse())
+	pool.Put(buffer, 20)
+	assert.Equal(t, int64(0), pool.InUse())
+}
+
+// blockingWriter holds up the first write until it is released.
+type blockingWriter struct {
+	bytes.Buffer
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.Buffer.Write(p)
+}
+
+func TestMaxBufferedBytesThrottlesFetching(t *testing.T) {
+	payload := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCD")
+	ranged := &atomic.Int32{}
+	server := newTestServer(payload, serverConfig{etag: `"v1"`, ranged: ranged})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	g := NewGranger(u, WithFragmentSize(4), WithParallelization(10), WithMaxBufferedBytes(8))
+	w := &blockingWriter{release: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		_, err := g.WriteTo(w)
+		done <- err
+	}()
+
+	// Only the first two fragments fit under the ceiling, after the probe for range support.
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(3), ranged.Load())
+
+	close(w.release)
+	assert.NoError(t, <-done)
+	assert.Equal(t, payload, w.Bytes())
+	assert.Equal(t, int32(11), ranged.Load())
+}
+
+func TestMaxBufferedBytesFailedFragment(t *testing.T) {
+	payload := bytes.Repeat([]byte("granger!"), 8)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "bytes=8-15" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	// The buffers of fragments which are never written mustn't hold up the rest of the download.
+	g := NewGranger(u, WithFragmentSize(8), WithParallelization(2), WithMaxBufferedBytes(16))
+	done := make(chan error)
+	go func() {
+		_, err := g.WriteTo(&bytes.Buffer{})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.ErrorContains(t, err, "403")
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteTo hung after a fragment failed")
+	}
+}
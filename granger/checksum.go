@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	AlgorithmMD5    = "md5"
+	AlgorithmSHA1   = "sha"
+	AlgorithmSHA256 = "sha-256"
+	AlgorithmSHA512 = "sha-512"
+	AlgorithmCRC32  = "crc32"
+	AlgorithmCRC32C = "crc32c"
+)
+
+var (
+	// ErrChecksumMismatch is returned by WriteTo when the bytes written don't match an expected digest.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrUnknownAlgorithm is returned when an expected digest uses an algorithm we can't compute.
+	ErrUnknownAlgorithm = errors.New("unknown checksum algorithm")
+)
+
+// Digest is the expected checksum of the source, along with the algorithm used to compute it.
+type Digest struct {
+	Algorithm string
+	Value     []byte
+	// Source describes where the digest came from, such as the header name.
+	Source string
+}
+
+// ChecksumMismatchError describes which digest didn't match. It matches ErrChecksumMismatch with errors.Is.
+type ChecksumMismatchError struct {
+	Expected Digest
+	Actual   []byte
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%v: %v from %v expected %v, got %v", ErrChecksumMismatch, e.Expected.Algorithm,
+		e.Expected.Source, base64.StdEncoding.EncodeToString(e.Expected.Value),
+		base64.StdEncoding.EncodeToString(e.Actual))
+}
+
+func (e *ChecksumMismatchError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case AlgorithmMD5:
+		return md5.New(), nil
+	case AlgorithmSHA1:
+		return sha1.New(), nil
+	case AlgorithmSHA256:
+		return sha256.New(), nil
+	case AlgorithmSHA512:
+		return sha512.New(), nil
+	case AlgorithmCRC32:
+		return crc32.NewIEEE(), nil
+	case AlgorithmCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	}
+	return nil, fmt.Errorf("%w: %v", ErrUnknownAlgorithm, algorithm)
+}
+
+// advertisedDigests returns every digest of the full representation that the server included in the response
+// headers. Digests we can't parse or compute are ignored.
+func advertisedDigests(header http.Header) []Digest {
+	var digests []Digest
+	add := func(algorithm, source, encoded string) {
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(value) == 0 {
+			return
+		}
+		if _, err := newHash(algorithm); err != nil {
+			return
+		}
+		digests = append(digests, Digest{Algorithm: algorithm, Value: value, Source: source})
+	}
+
+	if v := header.Get("Content-MD5"); v != "" {
+		add(AlgorithmMD5, "Content-MD5", v)
+	}
+	for _, v := range header.Values("Repr-Digest") {
+		for algorithm, encoded := range parseDigestDictionary(v) {
+			add(algorithm, "Repr-Digest", encoded)
+		}
+	}
+	// Checksums of multipart uploads are a checksum of the part checksums, suffixed with the part count. They
+	// can't be compared against the object as a whole.
+	if v := header.Get("x-amz-checksum-sha256"); v != "" && !strings.Contains(v, "-") {
+		add(AlgorithmSHA256, "x-amz-checksum-sha256", v)
+	}
+	if v := header.Get("x-amz-checksum-crc32c"); v != "" && !strings.Contains(v, "-") {
+		add(AlgorithmCRC32C, "x-amz-checksum-crc32c", v)
+	}
+	if v := header.Get("x-amz-checksum-crc32"); v != "" && !strings.Contains(v, "-") {
+		add(AlgorithmCRC32, "x-amz-checksum-crc32", v)
+	}
+	if v := header.Get("x-amz-checksum-sha1"); v != "" && !strings.Contains(v, "-") {
+		add(AlgorithmSHA1, "x-amz-checksum-sha1", v)
+	}
+
+	return digests
+}
+
+// parseDigestDictionary parses an RFC 9530 digest field, such as `sha-256=:base64:, sha-512=:base64:`, into a map
+// of algorithm to base64 value.
+func parseDigestDictionary(value string) map[string]string {
+	digests := map[string]string{}
+	for _, member := range strings.Split(value, ",") {
+		algorithm, encoded, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok {
+			continue
+		}
+		// Byte sequences are delimited by colons, and may be followed by parameters.
+		encoded, _, _ = strings.Cut(encoded, ";")
+		if len(encoded) < 2 || encoded[0] != ':' || encoded[len(encoded)-1] != ':' {
+			continue
+		}
+		digests[strings.ToLower(algorithm)] = encoded[1 : len(encoded)-1]
+	}
+	return digests
+}
+
+// verifier hashes everything written to it and compares the result against a set of expected digests.
+type verifier struct {
+	digests []Digest
+	hashes  []hash.Hash
+	writer  io.Writer
+}
+
+func newVerifier(digests []Digest) (*verifier, error) {
+	v := &verifier{digests: digests}
+	writers := make([]io.Writer, 0, len(digests))
+	for _, digest := range digests {
+		h, err := newHash(digest.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		v.hashes = append(v.hashes, h)
+		writers = append(writers, h)
+	}
+	v.writer = io.MultiWriter(writers...)
+
+	return v, nil
+}
+
+func (v *verifier) Write(p []byte) (int, error) {
+	return v.writer.Write(p)
+}
+
+// Verify returns a ChecksumMismatchError for the first digest which doesn't match.
+func (v *verifier) Verify() error {
+	for i, digest := range v.digests {
+		actual := v.hashes[i].Sum(nil)
+		if !bytes.Equal(actual, digest.Value) {
+			return &ChecksumMismatchError{Expected: digest, Actual: actual}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func b64(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func TestChecksumVerification(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	md5Sum := md5.Sum(payload)
+	sha256Sum := sha256.Sum256(payload)
+	sha512Sum := sha512.Sum512(payload)
+	crc32cSum := binary.BigEndian.AppendUint32(nil, crc32.Checksum(payload, crc32.MakeTable(crc32.Castagnoli)))
+	wrong := sha256.Sum256([]byte("something else"))
+
+	tests := map[string]struct {
+		headers  map[string]string
+		mismatch bool
+		// streamed serves the whole source regardless of the range requested.
+		streamed bool
+	}{
+		"no checksum": {
+			headers: map[string]string{},
+		},
+		"content-md5": {
+			headers:  map[string]string{"Content-MD5": b64(md5Sum[:])},
+			streamed: true,
+		},
+		"content-md5 of a partial response is ignored": {
+			headers: map[string]string{"Content-MD5": b64(wrong[:16])},
+		},
+		"repr-digest": {
+			headers: map[string]string{
+				"Repr-Digest": "sha-256=:" + b64(sha256Sum[:]) + ":, sha-512=:" + b64(sha512Sum[:]) + ":",
+			},
+		},
+		"x-amz-checksum-sha256": {
+			headers: map[string]string{"x-amz-checksum-sha256": b64(sha256Sum[:])},
+		},
+		"x-amz-checksum-crc32c": {
+			headers: map[string]string{"x-amz-checksum-crc32c": b64(crc32cSum)},
+		},
+		"multipart checksum is ignored": {
+			headers: map[string]string{"x-amz-checksum-sha256": b64(wrong[:]) + "-3"},
+		},
+		"content-md5 mismatch": {
+			headers:  map[string]string{"Content-MD5": b64(wrong[:16])},
+			mismatch: true,
+			streamed: true,
+		},
+		"repr-digest mismatch": {
+			headers:  map[string]string{"Repr-Digest": "sha-256=:" + b64(wrong[:]) + ":"},
+			mismatch: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var server *httptest.Server
+			if test.streamed {
+				server = newStreamingServer(payload, test.headers)
+			} else {
+				server = newTestServer(payload, serverConfig{headers: test.headers})
+			}
+			defer server.Close()
+
+			u, err := url.Parse(server.URL)
+			assert.NoError(t, err)
+
+			g := NewGranger(u, WithFragmentSize(8), WithParallelization(2), WithChecksumVerification())
+			buffer := &bytes.Buffer{}
+			_, err = g.WriteTo(buffer)
+			if test.mismatch {
+				assert.ErrorIs(t, err, ErrChecksumMismatch)
+				var mismatchErr *ChecksumMismatchError
+				assert.True(t, errors.As(err, &mismatchErr))
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, payload, buffer.Bytes())
+		})
+	}
+}
+
+func TestExpectedDigest(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := newTestServer(payload, serverConfig{})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	sum := sha256.Sum256(payload)
+	g := NewGranger(u, WithFragmentSize(8), WithExpectedDigest(AlgorithmSHA256, sum[:]))
+	_, err = g.WriteTo(&bytes.Buffer{})
+	assert.NoError(t, err)
+
+	g = NewGranger(u, WithFragmentSize(8), WithExpectedDigest(AlgorithmSHA256, []byte("nope")))
+	_, err = g.WriteTo(&bytes.Buffer{})
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+
+	g = NewGranger(u, WithExpectedDigest("whirlpool", []byte("nope")))
+	_, err = g.WriteTo(&bytes.Buffer{})
+	assert.ErrorIs(t, err, ErrUnknownAlgorithm)
+}
+
+func TestParseDigestDictionary(t *testing.T) {
+	digests := parseDigestDictionary(`sha-256=:AAAA:, SHA-512=:BBBB:;param=1, bogus, unixsum=42`)
+	assert.Equal(t, map[string]string{"sha-256": "AAAA", "sha-512": "BBBB"}, digests)
+}
+
+func TestChecksumIncludesResumedBytes(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	sum := sha256.Sum256(payload)
+	server := newTestServer(payload, serverConfig{
+		etag:    `"v1"`,
+		headers: map[string]string{"x-amz-checksum-sha256": b64(sum[:])},
+	})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "out.journal")
+	journal, err := OpenJournal(journalPath)
+	assert.NoError(t, err)
+	assert.NoError(t, journal.Reset(u.String(), `"v1"`, "", int64(len(payload))))
+	assert.NoError(t, journal.Commit(0, 8))
+	assert.NoError(t, journal.Close())
+
+	// The committed bytes are corrupt, which should be caught even though they aren't fetched again.
+	out, err := os.Create(filepath.Join(dir, "out"))
+	assert.NoError(t, err)
+	defer out.Close()
+	_, err = out.Write([]byte("HELLO wo"))
+	assert.NoError(t, err)
+
+	g := NewGranger(u, WithFragmentSize(8), WithResumeJournal(journalPath), WithChecksumVerification())
+	_, err = g.WriteTo(out)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+
+	// The journal can't be trusted anymore, so the next attempt starts from scratch.
+	_, err = os.Stat(journalPath)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocate reserves size bytes of disk for f up front, so that writing fragments out of order doesn't leave the
+// file fragmented on disk. Filesystems which don't support it fall back to extending the file.
+func fallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return f.Truncate(size)
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// fallocate extends f to size bytes. Other platforms don't have a portable way to reserve the space up front.
+func fallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
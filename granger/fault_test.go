@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fault is something which goes wrong with the response to a fragment.
+type fault func(w http.ResponseWriter, r *http.Request, payload []byte)
+
+var (
+	faultSlow fault = func(w http.ResponseWriter, r *http.Request, payload []byte) {
+		time.Sleep(20 * time.Millisecond)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	}
+	faultResetMidBody fault = func(w http.ResponseWriter, r *http.Request, payload []byte) {
+		first, last := requestedRange(r)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", first, last, len(payload)))
+		w.Header().Set("Content-Length", strconv.Itoa(last-first+1))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(payload[first : first+(last-first+1)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	faultWrongContentRange fault = func(w http.ResponseWriter, r *http.Request, payload []byte) {
+		first, last := requestedRange(r)
+		// The right number of bytes, but from the wrong place.
+		shift := 1
+		if first > 0 {
+			shift = -1
+		}
+		first, last = first+shift, last+shift
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", first, last, len(payload)))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(payload[first : last+1])
+	}
+	faultTruncatedBody fault = func(w http.ResponseWriter, r *http.Request, payload []byte) {
+		first, last := requestedRange(r)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", first, last, len(payload)))
+		w.Header().Set("Content-Length", strconv.Itoa(last-first+1))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(payload[first:last])
+	}
+)
+
+// faultStatus responds with code, and a Retry-After of 0 so that retries aren't held up.
+func faultStatus(code int) fault {
+	return func(w http.ResponseWriter, r *http.Request, payload []byte) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(code)
+	}
+}
+
+// requestedRange returns the first and last bytes asked for by r's Range header.
+func requestedRange(r *http.Request) (int, int) {
+	var first, last int
+	_, _ = fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last)
+	return first, last
+}
+
+// handler injects f into the responses for payload.
+func (f fault) handler(payload []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f(w, r, payload)
+	}
+}
+
+func TestWriteToFaults(t *testing.T) {
+	payload := randomPayload(64 * 1024)
+	tests := map[string]struct {
+		fault    fault
+		failures int
+		// expected is the status code WriteTo fails with, 0 if it fails some other way, or -1 if it succeeds.
+		expected int
+		attempts int
+	}{
+		"slow fragments":      {fault: faultSlow, failures: 1, expected: -1},
+		"reset mid-body":      {fault: faultResetMidBody, failures: 2, expected: -1},
+		"wrong content range": {fault: faultWrongContentRange, failures: 2, expected: -1},
+		"truncated body":      {fault: faultTruncatedBody, failures: 2, expected: -1},
+		"too many requests":   {fault: faultStatus(http.StatusTooManyRequests), failures: 2, expected: -1},
+		"service unavailable": {fault: faultStatus(http.StatusServiceUnavailable), failures: 2, expected: -1},
+		"range not satisfiable": {
+			fault: faultStatus(http.StatusRequestedRangeNotSatisfiable), failures: 1, expected: 416, attempts: 1,
+		},
+		"persistent reset":       {fault: faultResetMidBody, failures: 10, expected: 0, attempts: 3},
+		"persistent wrong range": {fault: faultWrongContentRange, failures: 10, expected: 0, attempts: 3},
+		"persistent service unavailable": {
+			fault: faultStatus(http.StatusServiceUnavailable), failures: 10, expected: 503, attempts: 3,
+		},
+	}
+
+	// Each scenario runs against a real server, and against the same handler through MockHTTPClient.
+	clients := map[string]func(handler http.Handler) (*url.URL, []Option, func()){
+		"server": func(handler http.Handler) (*url.URL, []Option, func()) {
+			server := httptest.NewServer(handler)
+			u, _ := url.Parse(server.URL)
+			return u, nil, server.Close
+		},
+		"mock": func(handler http.Handler) (*url.URL, []Option, func()) {
+			u, _ := url.Parse("http://granger.test/payload")
+			return u, []Option{WithHTTPClient(NewMockHTTPClient(handler))}, func() {}
+		},
+	}
+
+	for name, test := range tests {
+		for clientName, newClient := range clients {
+			t.Run(name+"/"+clientName, func(t *testing.T) {
+				u, options, closeClient := newClient(newFlakyHandler(payload, test.failures, test.fault.handler(payload)))
+				defer closeClient()
+				options = append(options, WithFragmentSize(8*1024), WithParallelization(4),
+					WithRetryPolicy(3, time.Millisecond, 0))
+
+				buffer := &bytes.Buffer{}
+				_, err := NewGranger(u, options...).WriteToContext(context.Background(), buffer)
+				if test.expected < 0 {
+					assert.NoError(t, err)
+					assert.Equal(t, payload, buffer.Bytes())
+					return
+				}
+
+				fragmentErr := &FragmentError{}
+				assert.ErrorAs(t, err, &fragmentErr)
+				assert.Equal(t, test.attempts, fragmentErr.Attempts)
+				statusErr := &StatusError{}
+				if test.expected > 0 {
+					assert.ErrorAs(t, err, &statusErr)
+					assert.Equal(t, test.expected, statusErr.StatusCode)
+				} else {
+					assert.False(t, errors.As(err, &statusErr))
+				}
+			})
+		}
+	}
+}
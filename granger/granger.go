@@ -2,12 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
 	"net/http"
 	"net/url"
+	"pipeline"
 	"strconv"
+	"sync"
+	"time"
 )
 
 const (
@@ -15,11 +19,45 @@ const (
 )
 
 type Granger struct {
-	httpClient      *http.Client
+	httpClient      HTTPDoer
+	protocol        Protocol
+	maxConnsPerHost int
+	tlsConfig       *tls.Config
+	headers         http.Header
+	signer          RequestSigner
 	srcUrl          *url.URL
-	ojp             *OrderedJobProcessor
+	source          Source
+	ojp             *pipeline.Processor
 	fragmentSize    int
 	parallelization int
+	reorderWindow   int
+	hedgePolicy     *pipeline.HedgePolicy
+	journalPath     string
+	retryPolicy     RetryPolicy
+	verifyChecksums bool
+	expectedDigests []Digest
+	adaptivePolicy  *AdaptivePolicy
+	mirrorUrls      []*url.URL
+	maxBuffered     int64
+	prefetchDepth   int
+	blockSize       int
+	blockCacheSize  int
+	maxReadAhead    int
+	observer        Observer
+	rateLimiter     *RateLimiter
+	// fetchSlots, if set, is shared with other downloads to limit how many fragments are fetched at once across all
+	// of them.
+	fetchSlots *pipeline.Semaphore
+}
+
+// download holds the state of a single call to WriteTo.
+type download struct {
+	w        io.Writer
+	journal  *Journal
+	tuner    *tuner
+	mirrors  *mirrorSet
+	buffers  *bufferPool
+	progress *progress
 }
 
 type Option func(g *Granger)
@@ -30,72 +68,340 @@ func WithParallelization(parallelization int) Option {
 	}
 }
 
+// WithReorderWindow lets up to n fragments be fetched or waiting to be written at once. Fragments are written in
+// order, so by default a slow fragment stops any more being fetched until it arrives; a window larger than the
+// parallelization lets fast fragments keep being fetched behind it, at the cost of holding up to n fragments in
+// memory, or the limit given to WithMaxBufferedBytes.
+func WithReorderWindow(n int) Option {
+	return func(g *Granger) {
+		g.reorderWindow = n
+	}
+}
+
+// WithHedging starts a duplicate fetch of the fragment every later fragment is waiting on, once it has taken longer
+// than policy allows, and uses whichever copy arrives first. The duplicate has a buffer of its own, so one more
+// fragment than WithMaxBufferedBytes allows may be held in memory while it runs.
+func WithHedging(policy pipeline.HedgePolicy) Option {
+	return func(g *Granger) {
+		g.hedgePolicy = &policy
+	}
+}
+
 func WithFragmentSize(fragmentSize int) Option {
 	return func(g *Granger) {
 		g.fragmentSize = fragmentSize
 	}
 }
 
+// WithResumeJournal records committed fragments in a journal at path, so that an interrupted download can pick up
+// where it left off. The destination must be seekable for a download to be resumed.
+func WithResumeJournal(path string) Option {
+	return func(g *Granger) {
+		g.journalPath = path
+	}
+}
+
+// WithRetryPolicy retries a failed fragment up to maxAttempts times in total. The delay before each retry starts at
+// backoff and doubles every attempt, with up to jitter (0 to 1) of it randomized. A Retry-After header sent by the
+// server takes precedence over the backoff.
+func WithRetryPolicy(maxAttempts int, backoff time.Duration, jitter float64) Option {
+	return func(g *Granger) {
+		g.retryPolicy = RetryPolicy{
+			MaxAttempts: maxAttempts,
+			Backoff:     backoff,
+			Jitter:      jitter,
+		}
+	}
+}
+
+// WithChecksumVerification hashes the bytes as they are written and compares them against any checksum advertised by
+// the server, such as Content-MD5, Repr-Digest or x-amz-checksum-*. WriteTo returns an error matching
+// ErrChecksumMismatch if they differ.
+func WithChecksumVerification() Option {
+	return func(g *Granger) {
+		g.verifyChecksums = true
+	}
+}
+
+// WithExpectedDigest verifies the bytes written against a digest supplied by the caller, computed with one of the
+// Algorithm* constants. It can be used alongside WithChecksumVerification.
+func WithExpectedDigest(algorithm string, value []byte) Option {
+	return func(g *Granger) {
+		g.expectedDigests = append(g.expectedDigests, Digest{
+			Algorithm: algorithm,
+			Value:     value,
+			Source:    "caller",
+		})
+	}
+}
+
+// WithAdaptiveTuning measures the throughput and latency of each fragment as the download runs, and adjusts the
+// fragment size and parallelization within the bounds of policy to get the best aggregate bandwidth. The values given
+// to WithFragmentSize and WithParallelization are used as a starting point, and in place of any bounds left at zero.
+func WithAdaptiveTuning(policy AdaptivePolicy) Option {
+	return func(g *Granger) {
+		g.adaptivePolicy = &policy
+	}
+}
+
+// WithMirrors adds endpoints which serve the same content as the source URL. Fragments are spread across the source
+// and the mirrors, favouring whichever have been fastest, and a failed fragment is retried on a different mirror. A
+// mirror is only used if its Content-Length and ETag match the source.
+func WithMirrors(mirrors ...*url.URL) Option {
+	return func(g *Granger) {
+		g.mirrorUrls = append(g.mirrorUrls, mirrors...)
+	}
+}
+
+// WithMaxBufferedBytes caps how many bytes of fragments may be held in memory at once. Once the cap is reached, no
+// more fragments are fetched until earlier ones have been written out, so a slow writer throttles the download.
+func WithMaxBufferedBytes(maxBytes int64) Option {
+	return func(g *Granger) {
+		g.maxBuffered = maxBytes
+	}
+}
+
+// HTTPDoer sends HTTP requests. *http.Client implements it, and MockHTTPClient stands in for one in tests.
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// WithHTTPClient sends every request with client, e.g. to use a custom transport or proxy. Defaults to a client
+// with a transport set up by WithProtocol, WithMaxConnsPerHost and WithTLSConfig.
+func WithHTTPClient(client HTTPDoer) Option {
+	return func(g *Granger) {
+		g.httpClient = client
+	}
+}
+
+// WithRequestHeaders adds headers to every request sent for the source. A Host header overrides the host sent.
+func WithRequestHeaders(headers http.Header) Option {
+	return func(g *Granger) {
+		for k, v := range headers {
+			k = http.CanonicalHeaderKey(k)
+			g.headers[k] = append(g.headers[k], v...)
+		}
+	}
+}
+
 func NewGranger(uri *url.URL, options ...Option) *Granger {
 	g := &Granger{
-		httpClient:      http.DefaultClient,
+		headers:         http.Header{},
 		srcUrl:          uri,
 		parallelization: defaultParallelization,
+		retryPolicy:     RetryPolicy{MaxAttempts: defaultMaxAttempts},
+		blockSize:       defaultBlockSize,
+		blockCacheSize:  defaultBlockCacheSize,
+		maxReadAhead:    defaultMaxReadAhead,
+		// Without a limit the rate limiter lets everything through, but it's there so that a limit can be set later.
+		rateLimiter: NewRateLimiter(0),
 	}
 
 	for _, opt := range options {
 		opt(g)
 	}
+	if g.httpClient == nil {
+		g.httpClient = &http.Client{Transport: g.newTransport()}
+	}
+	if g.source == nil {
+		g.source = &httpSource{g: g, url: uri}
+	}
 
-	g.ojp = NewOrderedJobProcessor(g.parallelization)
-
-	if uri.Scheme == "https" {
-		g.httpClient.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{},
-		}
+	ojpOptions := []pipeline.Option{pipeline.WithReorderWindow(g.reorderWindow)}
+	if g.hedgePolicy != nil {
+		ojpOptions = append(ojpOptions, pipeline.WithHedging(*g.hedgePolicy))
 	}
+	g.ojp = pipeline.New(g.parallelization, ojpOptions...)
 
 	return g
 }
 
 func (r *Granger) WriteTo(w io.Writer) (int64, error) {
-	initResp, err := r.initRequest()
+	return r.WriteToContext(context.Background(), w)
+}
+
+// WriteToContext is like WriteTo, but stops fetching fragments and returns an error once ctx is cancelled.
+func (r *Granger) WriteToContext(ctx context.Context, w io.Writer) (int64, error) {
+	info, err := r.stat(ctx)
 	if err != nil {
 		return 0, err
 	}
-	contentLength := initResp.Header.Get("Content-Length")
-	// If we're unable to parse the content-length, then this will return an error and default to 0. Let's ignore
-	// the error and use the default instead.
-	totalSize, _ := strconv.ParseInt(contentLength, 10, 64)
+	if !info.rangeable {
+		return r.stream(ctx, w, info)
+	}
+	totalSize := info.Size
 
-	if r.fragmentSize == 0 {
-		r.fragmentSize = int(totalSize)
+	if wa, ok := writerAtFor(w); ok {
+		n, err := r.writeToAt(ctx, wa, info)
+		if err == nil {
+			// Leave the file positioned after what we wrote, as it would be had we written it in order.
+			if s, ok := w.(io.Seeker); ok {
+				_, err = s.Seek(totalSize, io.SeekStart)
+			}
+		}
+		return n, err
 	}
-	numFragments := int(totalSize) / r.fragmentSize
-	if numFragments == 0 {
-		numFragments = 1
+
+	var journal *Journal
+	offset := int64(0)
+	if r.journalPath != "" {
+		journal, err = r.openJournal(info)
+		if err != nil {
+			return 0, err
+		}
+		// Position w after the bytes which have already been committed.
+		offset = journal.CommittedOffset()
+		if err := seekDestination(w, offset); err != nil {
+			_ = journal.Close()
+			return 0, err
+		}
+	}
+
+	var verifier *verifier
+	if r.verifyChecksums || len(r.expectedDigests) > 0 {
+		verifier, err = r.newVerifier(info.Digests, w, offset)
+		if err != nil {
+			if journal != nil {
+				_ = journal.Close()
+			}
+			return 0, err
+		}
+		w = io.MultiWriter(w, verifier)
+	}
+
+	progress := r.newProgress(offset, totalSize)
+	if offset >= totalSize {
+		if err := r.verify(verifier, journal); err != nil {
+			return 0, err
+		}
+		if journal != nil {
+			return 0, journal.Remove()
+		}
+		return 0, nil
+	}
+
+	var tuner *tuner
+	if r.adaptivePolicy != nil {
+		fragmentSize := r.fragmentSize
+		if fragmentSize == 0 {
+			fragmentSize = int(totalSize)
+		}
+		tuner = newTuner(*r.adaptivePolicy, fragmentSize, r.parallelization, r.ojp.SetParallelization)
+		defer r.ojp.SetParallelization(r.parallelization)
+	}
+	d := &download{
+		w:        w,
+		journal:  journal,
+		tuner:    tuner,
+		mirrors:  r.newMirrorSet(ctx, info),
+		buffers:  newBufferPool(r.maxBuffered),
+		progress: progress,
+	}
+
+	// Once a fragment fails, no more fragments are written, so their buffers won't be returned to the pool. Stop
+	// waiting for them.
+	poolCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(r.ojp.Context(), cancel)
+	defer stop()
+
+	planner := newFragmentPlanner(offset, totalSize, r.fragmentSizer(tuner, info.Parts))
+	// submitErr is why we stopped submitting fragments early, if we did. The fragments which were submitted may all
+	// have succeeded, but the download is still incomplete.
+	var submitErr error
+	for rng, ok := planner.Next(); ok; rng, ok = planner.Next() {
+		fragment := newHttpFragment(r.srcUrl, rng)
+		// Buffers are reserved in order, so the next fragment to be written always has one and we can't deadlock.
+		buffer, err := d.buffers.Get(poolCtx, int(rng.size()))
+		if err == nil {
+			if err = r.processFragment(ctx, fragment, buffer, d); err != nil {
+				d.buffers.Put(buffer, int(rng.size()))
+			}
+		}
+		if err != nil {
+			submitErr = err
+			break
+		}
 	}
-	for i := 0; i < numFragments; i++ {
-		startPos := i * r.fragmentSize
-		endPos := min(startPos+r.fragmentSize, int(totalSize))
 
-		fragment := &HttpFragment{
-			srcUrl:   r.srcUrl,
-			startPos: startPos,
-			endPos:   endPos,
+	err = r.ojp.Wait()
+	if err == nil {
+		err = submitErr
+	}
+	if err != nil {
+		if journal != nil {
+			_ = journal.Close()
+		}
+		return 0, err
+	}
+	if err := r.verify(verifier, journal); err != nil {
+		return totalSize - offset, err
+	}
+	if journal != nil {
+		if err := journal.Remove(); err != nil {
+			return totalSize - offset, err
 		}
+	}
+	return totalSize - offset, nil
+}
+
+// openJournal loads the resume journal. If the source has changed since the journal was written, the journal is
+// reset and the download starts over.
+func (r *Granger) openJournal(info *sourceInfo) (*Journal, error) {
+	journal, err := OpenJournal(r.journalPath)
+	if err != nil {
+		return nil, err
+	}
+	name := r.sourceName()
 
-		if i == 0 {
-			fragment.resp = initResp
+	if !journal.Matches(name, info.ETag, info.LastModified, info.Size) {
+		if err := journal.Reset(name, info.ETag, info.LastModified, info.Size); err != nil {
+			_ = journal.Close()
+			return nil, err
 		}
-		r.processFragment(fragment, w)
+	}
+	return journal, nil
+}
+
+// newVerifier builds a verifier for the advertised and expected digests. If we're resuming a download, the bytes
+// which were already committed are read back from w so that they are included in the checksum.
+func (r *Granger) newVerifier(advertised []Digest, w io.Writer, offset int64) (*verifier, error) {
+	digests := append([]Digest{}, r.expectedDigests...)
+	if r.verifyChecksums {
+		digests = append(digests, advertised...)
+	}
+	v, err := newVerifier(digests)
+	if err != nil {
+		return nil, err
+	}
+	if offset == 0 {
+		return v, nil
 	}
 
-	r.ojp.Wait()
-	return totalSize, nil
+	readerAt, ok := w.(io.ReaderAt)
+	if !ok {
+		return nil, errors.New("unable to verify checksum of a resumed download, destination is not readable")
+	}
+	if _, err := io.Copy(v, io.NewSectionReader(readerAt, 0, offset)); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// verify checks the bytes written against the expected digests. On a mismatch the journal is removed, since the
+// bytes it claims were committed can't be trusted.
+func (r *Granger) verify(v *verifier, journal *Journal) error {
+	if v == nil {
+		return nil
+	}
+	err := v.Verify()
+	if err != nil && journal != nil {
+		_ = journal.Remove()
+	}
+	return err
 }
 
-func (r *Granger) initRequest() (*http.Response, error) {
+func (r *Granger) initRequest(ctx context.Context) (*http.Response, error) {
 	req := &http.Request{
 		Method:     "GET",
 		Proto:      "HTTP/1.1",
@@ -103,36 +409,197 @@ func (r *Granger) initRequest() (*http.Response, error) {
 		ProtoMinor: 1,
 		URL:        r.srcUrl,
 	}
-	resp, err := r.httpClient.Do(req)
+	resp, err := r.do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
 	if !isSuccessResp(resp) {
-		return nil, errors.New("received non-200 code")
+		_ = resp.Body.Close()
+		return nil, newStatusError(resp)
 	}
 
 	return resp, nil
 }
 
+// do sends req to the source, after adding the request headers and signing it. If the server rejects the signer's
+// credentials and they can be refreshed, the request is signed and sent once more. Mirrors get neither.
+func (r *Granger) do(req *http.Request) (*http.Response, error) {
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	for k, v := range r.headers {
+		if k == "Host" {
+			req.Host = v[0]
+			continue
+		}
+		// Don't let the request headers clobber the Range we're asking for.
+		if _, ok := req.Header[k]; !ok {
+			req.Header[k] = v
+		}
+	}
+	if r.signer == nil {
+		return r.httpClient.Do(req)
+	}
+
+	// The URL is shared by every request for the source, and signing may normalize it.
+	u := *req.URL
+	req.URL = &u
+	if err := r.signer.Sign(req); err != nil {
+		return nil, err
+	}
+	resp, err := r.httpClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	invalidator, ok := r.signer.(invalidator)
+	if !ok {
+		return resp, nil
+	}
+	_ = resp.Body.Close()
+	invalidator.Invalidate()
+	if err := r.signer.Sign(req); err != nil {
+		return nil, err
+	}
+	return r.httpClient.Do(req)
+}
+
+// headRequest issues a HEAD request for source, returning an error unless it succeeds.
+func (r *Granger) headRequest(ctx context.Context, source *httpSource) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, source.url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := source.do(req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if !isSuccessResp(resp) {
+		return nil, newStatusError(resp)
+	}
+	return resp, nil
+}
+
+func parseContentLength(resp *http.Response) (int64, error) {
+	return strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+}
+
 func isSuccessResp(resp *http.Response) bool {
 	return resp.StatusCode/100 == 2
 }
 
-func (r *Granger) processFragment(fragment *HttpFragment, w io.Writer) {
-	var buff *bytes.Buffer
-	job := func() error {
-		buffer, err := fragment.Start(r.httpClient)
+// processFragment fetches fragment in the background and writes it to the destination once every preceding fragment
+// has been written. An error is returned if the fragment could not be submitted because ctx was cancelled or an
+// earlier fragment failed.
+func (r *Granger) processFragment(ctx context.Context, fragment *HttpFragment, buffer *bytes.Buffer,
+	d *download) error {
+	size := fragment.endPos - fragment.startPos
+	// The buffer goes back to the pool once, when the fragment has been written, when fetching it fails, or when it
+	// won't be written because another fragment failed.
+	var once sync.Once
+	release := func(buffer *bytes.Buffer) {
+		once.Do(func() {
+			d.buffers.Put(buffer, size)
+		})
+	}
+
+	job := func(ctx context.Context) (*bytes.Buffer, error) {
+		if pipeline.Attempt(ctx) > 0 {
+			// A hedged fetch races the original, so can't share its buffer.
+			hedgeBuffer := newFragmentBuffer(size)
+			return hedgeBuffer, r.fetchFragment(ctx, fragment, hedgeBuffer, d)
+		}
+		if err := r.fetchFragment(ctx, fragment, buffer, d); err != nil {
+			release(buffer)
+			return nil, err
+		}
+		if r.ojp.Context().Err() != nil {
+			// Callbacks are skipped once anything has failed.
+			release(buffer)
+		}
+		return buffer, nil
+	}
+
+	cb := func(buffer *bytes.Buffer) error {
+		n, err := io.Copy(d.w, buffer)
 		if err != nil {
 			return err
 		}
-		buff = buffer
+		d.progress.Add(n)
+		release(buffer)
+		if d.journal != nil {
+			return d.journal.Commit(int64(fragment.startPos), int64(fragment.endPos))
+		}
 		return nil
 	}
 
-	cb := func() error {
-		_, err := io.Copy(w, buff)
-		return err
+	// Fetching a fragment can safely be repeated, so it may be hedged.
+	return pipeline.Submit(ctx, r.ojp, job, cb, pipeline.Idempotent())
+}
+
+// fetchFragment fetches fragment into buffer, retrying according to the retry policy and spreading attempts across
+// mirrors.
+func (r *Granger) fetchFragment(ctx context.Context, fragment *HttpFragment, buffer *bytes.Buffer, d *download) error {
+	// Make sure every mirror gets a chance before we give up on the fragment.
+	policy := r.retryPolicy
+	policy.MaxAttempts = max(policy.MaxAttempts, d.mirrors.Len())
+
+	rng := fragment.byteRange()
+	observed := Fragment{Offset: rng.first, Size: rng.size()}
+	observer := r.observer
+	if observer == nil {
+		observer = NopObserver{}
 	}
 
-	r.ojp.SubmitJob(job, cb)
+	var source *mirror
+	var stats FragmentStats
+	attempts, err := policy.do(ctx, func() error {
+		source = d.mirrors.Pick(source)
+		if r.fetchSlots != nil {
+			if err := r.fetchSlots.AcquireContext(ctx); err != nil {
+				return err
+			}
+			defer r.fetchSlots.Release()
+		}
+		stats = FragmentStats{Attempt: stats.Attempt + 1}
+		ctx := observer.FragmentStarted(ctx, observed, stats.Attempt)
+		buffer.Reset()
+		w := &firstByteWriter{w: r.limitWriter(ctx, buffer)}
+		start := time.Now()
+		err := source.source.Fetch(ctx, rng.first, rng.last, w)
+		if err == nil && int64(buffer.Len()) != rng.size() {
+			err = io.ErrUnexpectedEOF
+		}
+		stats.Elapsed = time.Since(start)
+		if !w.firstByte.IsZero() {
+			stats.Latency = w.firstByte.Sub(start)
+		}
+		observer.FragmentCompleted(ctx, observed, stats, err)
+		if err != nil {
+			if ctx.Err() == nil {
+				d.mirrors.Failure(source)
+				// A client error, such as a 404, is likely to be particular to this mirror.
+				if !isRetryable(err) && d.mirrors.Evict(source) {
+					return &failoverError{err: err}
+				}
+			}
+			return err
+		}
+		d.mirrors.Success(source, int64(buffer.Len()), stats.Elapsed)
+		return nil
+	}, func(attempt int, delay time.Duration, err error) {
+		observer.Retry(observed, attempt, delay, err)
+	})
+	if err != nil {
+		return &FragmentError{
+			StartPos: fragment.startPos,
+			EndPos:   fragment.endPos,
+			Attempts: attempts,
+			Err:      err,
+		}
+	}
+	if d.tuner != nil {
+		d.tuner.Observe(int64(buffer.Len()), stats.Latency, stats.Elapsed)
+	}
+	return nil
 }
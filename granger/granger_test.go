@@ -2,11 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"pipeline"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestHappyCase(t *testing.T) {
@@ -30,6 +36,165 @@ func TestHappyCase(t *testing.T) {
 	assert.Equal(t, buffer.Bytes(), payload)
 }
 
+func TestWriteToContextCancelled(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rng := r.Header.Get("Range"); rng != "" && rng != "bytes=0-0" {
+			// Hang until the client gives up.
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	g := NewGranger(u, WithFragmentSize(8), WithParallelization(2))
+	_, err = g.WriteToContext(ctx, &bytes.Buffer{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// cancellingWriter cancels a context the first time it is written to.
+type cancellingWriter struct {
+	bytes.Buffer
+	cancel context.CancelFunc
+}
+
+func (w *cancellingWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	return w.Buffer.Write(p)
+}
+
+func TestWriteToContextCancelledWhileSubmitting(t *testing.T) {
+	payload := bytes.Repeat([]byte("granger!"), 8)
+	server := newTestServer(payload, serverConfig{})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+	journalPath := filepath.Join(t.TempDir(), "out.journal")
+
+	// The first fragment's callback cancels ctx while the next fragment is waiting to be submitted, so every job
+	// which was submitted succeeds but the download is incomplete.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &cancellingWriter{cancel: cancel}
+	g := NewGranger(u, WithFragmentSize(8), WithParallelization(1), WithResumeJournal(journalPath))
+	_, err = g.WriteToContext(ctx, w)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, w.Len(), len(payload))
+
+	// The journal is kept so the download can be resumed.
+	_, err = os.Stat(journalPath)
+	assert.NoError(t, err)
+}
+
+func TestReorderWindow(t *testing.T) {
+	payload := randomPayload(64)
+	others := atomic.Int32{}
+	allRequested := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Range") {
+		case "bytes=0-0":
+		case "bytes=0-7":
+			// The first fragment straggles until every other fragment has been requested behind it.
+			select {
+			case <-allRequested:
+			case <-time.After(2 * time.Second):
+			}
+		default:
+			if others.Add(1) == 7 {
+				close(allRequested)
+			}
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	g := NewGranger(u, WithFragmentSize(8), WithParallelization(2), WithReorderWindow(8))
+	start := time.Now()
+	buffer := &bytes.Buffer{}
+	_, err = g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, buffer.Bytes())
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestHedging(t *testing.T) {
+	payload := randomPayload(64)
+	stragglers := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first request for the second fragment hangs until it is cancelled.
+		if r.Header.Get("Range") == "bytes=8-15" && stragglers.Add(1) == 1 {
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	g := NewGranger(u, WithFragmentSize(8), WithParallelization(2),
+		WithHedging(pipeline.HedgePolicy{MinDelay: 20 * time.Millisecond}))
+	buffer := &bytes.Buffer{}
+	_, err = g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, buffer.Bytes())
+	assert.Equal(t, int32(2), stragglers.Load())
+}
+
+func TestAdaptiveTuning(t *testing.T) {
+	payload := make([]byte, 1000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	g := NewGranger(u, WithFragmentSize(16), WithParallelization(2), WithAdaptiveTuning(AdaptivePolicy{
+		MinFragmentSize:    7,
+		MaxFragmentSize:    100,
+		MinParallelization: 1,
+		MaxParallelization: 4,
+	}))
+	buffer := &bytes.Buffer{}
+	n, err := g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(payload)), n)
+	assert.Equal(t, payload, buffer.Bytes())
+}
+
+func TestAdaptiveTuningZeroBounds(t *testing.T) {
+	payload := make([]byte, 4096)
+	ranged := &atomic.Int32{}
+	server := newTestServer(payload, serverConfig{ranged: ranged})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	// Only the parallelization is bounded, so the fragment size stays as it was given.
+	g := NewGranger(u, WithFragmentSize(MiB), WithAdaptiveTuning(AdaptivePolicy{MaxParallelization: 8}))
+	buffer := &bytes.Buffer{}
+	_, err = g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, buffer.Bytes())
+	assert.Equal(t, int32(2), ranged.Load())
+}
+
 func BenchmarkHappyCase(b *testing.B) {
 	payload := []byte("hello world")
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
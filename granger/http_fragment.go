@@ -1,50 +1,91 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 )
 
+// HttpFragment fetches the bytes of the source from startPos up to, but not including, endPos.
 type HttpFragment struct {
 	srcUrl   *url.URL
 	startPos int
 	endPos   int
-	resp     *http.Response
 }
 
-func (h *HttpFragment) Start(httpClient *http.Client) (*bytes.Buffer, error) {
-	// Check to see if we have response already
-	if h.resp == nil {
-		req := &http.Request{
-			Method:     "GET",
-			URL:        h.srcUrl,
-			Proto:      "HTTP/1.1",
-			ProtoMajor: 1,
-			ProtoMinor: 1,
-			Header: http.Header{
-				"Range": {
-					fmt.Sprintf("bytes=%v-%v", h.startPos, h.endPos),
-				},
+func newHttpFragment(srcUrl *url.URL, rng byteRange) *HttpFragment {
+	return &HttpFragment{
+		srcUrl:   srcUrl,
+		startPos: int(rng.first),
+		endPos:   int(rng.last + 1),
+	}
+}
+
+// RangeError is returned when the response to a ranged request doesn't cover exactly the range which was requested.
+type RangeError struct {
+	Requested    string
+	StatusCode   int
+	ContentRange string
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("requested %v, received %v with Content-Range %q", e.Requested, e.StatusCode, e.ContentRange)
+}
+
+// Start fetches the fragment and writes it to w. The request is sent with do.
+func (h *HttpFragment) Start(ctx context.Context, do func(*http.Request) (*http.Response, error), w io.Writer) error {
+	rng := h.byteRange()
+	req := &http.Request{
+		Method:     "GET",
+		URL:        h.srcUrl,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Range": {
+				rng.String(),
 			},
+		},
+	}
+	resp, err := do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !isSuccessResp(resp) {
+		return newStatusError(resp)
+	}
+	if err := h.checkContentRange(resp, rng); err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, resp.Body, int64(h.endPos-h.startPos))
+	return err
+}
+
+// byteRange returns the range of bytes sent in the Range header, whose end is inclusive.
+func (h *HttpFragment) byteRange() byteRange {
+	return byteRange{first: int64(h.startPos), last: int64(h.endPos) - 1}
+}
+
+// checkContentRange makes sure resp is a partial response for the range we requested. Servers shorten a range which
+// runs past the end of the source, so the last byte may be the last byte of the source instead.
+func (h *HttpFragment) checkContentRange(resp *http.Response, rng byteRange) error {
+	contentRange := resp.Header.Get("Content-Range")
+	if resp.StatusCode == http.StatusPartialContent {
+		first, last, total, err := parseContentRange(contentRange)
+		wantLast := rng.last
+		if total >= 0 {
+			wantLast = min(rng.last, total-1)
 		}
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			return nil, err
-		}
-		if !isSuccessResp(resp) {
-			return nil, fmt.Errorf("received non-200 code: %v", resp.StatusCode)
+		if err == nil && first == rng.first && last == wantLast {
+			return nil
 		}
-		h.resp = resp
 	}
-	defer h.resp.Body.Close()
-	size := h.endPos - h.startPos
-	buffer := &bytes.Buffer{}
-	_, err := io.CopyN(buffer, h.resp.Body, int64(size))
-	if err != nil {
-		return nil, err
+	return &RangeError{
+		Requested:    rng.String(),
+		StatusCode:   resp.StatusCode,
+		ContentRange: contentRange,
 	}
-	return buffer, nil
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrResumeNotSeekable is returned when a download should be resumed part way through, but the destination
+	// cannot be repositioned to the end of the committed bytes.
+	ErrResumeNotSeekable = errors.New("destination does not support seeking, unable to resume")
+)
+
+// Journal records which byte ranges of a source have been committed to the destination, so that an interrupted
+// download can be resumed. The journal is a sidecar file containing a JSON header line that identifies the source,
+// followed by one JSON line per committed range.
+type Journal struct {
+	path      string
+	file      *os.File
+	header    journalHeader
+	committed []journalRange
+	mu        sync.Mutex
+}
+
+// journalHeader identifies the version of the source that the committed ranges belong to.
+type journalHeader struct {
+	Url          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Size         int64  `json:"size"`
+}
+
+// journalRange is a half-open byte range [Start, End) which has been written to the destination.
+type journalRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// OpenJournal opens the journal at path, loading any ranges which were committed by a previous run.
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		path: path,
+		file: file,
+	}
+	if err := j.load(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	reader := bufio.NewReader(j.file)
+	valid := int64(0)
+	for i := 0; ; i++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// The last line may be partially written if we were interrupted while committing it. It is safe to
+			// drop, since the range will simply be fetched again.
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			// A header we can't parse means we know nothing about the source, so treat the journal as empty.
+			if err := json.Unmarshal(line, &j.header); err != nil {
+				j.header = journalHeader{}
+				break
+			}
+		} else {
+			var rng journalRange
+			if err := json.Unmarshal(line, &rng); err != nil {
+				break
+			}
+			j.committed = append(j.committed, rng)
+		}
+		valid += int64(len(line))
+	}
+
+	// Drop anything we couldn't parse so that new commits are appended after the last valid line.
+	if err := j.file.Truncate(valid); err != nil {
+		return err
+	}
+	_, err := j.file.Seek(valid, io.SeekStart)
+
+	return err
+}
+
+// Matches returns true if the journal was written for the same version of the source. A source without an ETag or
+// Last-Modified header can't be validated, so it never matches.
+func (j *Journal) Matches(url, etag, lastModified string, size int64) bool {
+	if etag == "" && lastModified == "" {
+		return false
+	}
+	return j.header == journalHeader{Url: url, ETag: etag, LastModified: lastModified, Size: size}
+}
+
+// Reset discards all committed ranges and starts a new journal for the given version of the source.
+func (j *Journal) Reset(url, etag, lastModified string, size int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	j.header = journalHeader{Url: url, ETag: etag, LastModified: lastModified, Size: size}
+	j.committed = nil
+
+	return j.append(j.header)
+}
+
+// Commit records that the byte range [start, end) has been written to the destination.
+func (j *Journal) Commit(start, end int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	rng := journalRange{Start: start, End: end}
+	if err := j.append(rng); err != nil {
+		return err
+	}
+	j.committed = append(j.committed, rng)
+
+	return nil
+}
+
+func (j *Journal) append(v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// CommittedOffset returns the end of the contiguous range of committed bytes starting at 0.
+func (j *Journal) CommittedOffset() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ranges := make([]journalRange, len(j.committed))
+	copy(ranges, j.committed)
+	sort.Slice(ranges, func(a, b int) bool {
+		return ranges[a].Start < ranges[b].Start
+	})
+
+	offset := int64(0)
+	for _, rng := range ranges {
+		if rng.Start > offset {
+			break
+		}
+		offset = max(offset, rng.End)
+	}
+
+	return offset
+}
+
+// Gaps returns the ranges between 0 and size which haven't been committed yet, in order.
+func (j *Journal) Gaps(size int64) []journalRange {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ranges := make([]journalRange, len(j.committed))
+	copy(ranges, j.committed)
+	sort.Slice(ranges, func(a, b int) bool {
+		return ranges[a].Start < ranges[b].Start
+	})
+
+	var gaps []journalRange
+	offset := int64(0)
+	for _, rng := range ranges {
+		if rng.Start > offset && offset < size {
+			gaps = append(gaps, journalRange{Start: offset, End: min(rng.Start, size)})
+		}
+		offset = max(offset, rng.End)
+	}
+	if offset < size {
+		gaps = append(gaps, journalRange{Start: offset, End: size})
+	}
+	return gaps
+}
+
+// Close closes the journal, leaving it on disk so that the download can be resumed.
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// Remove closes and deletes the journal once the download has completed.
+func (j *Journal) Remove() error {
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(j.path)
+}
+
+// seekDestination positions w so that the next write happens at offset, discarding anything that was written past
+// the last committed range.
+func seekDestination(w io.Writer, offset int64) error {
+	if t, ok := w.(interface{ Truncate(int64) error }); ok {
+		if err := t.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	s, ok := w.(io.Seeker)
+	if !ok {
+		if offset == 0 {
+			return nil
+		}
+		return ErrResumeNotSeekable
+	}
+	_, err := s.Seek(offset, io.SeekStart)
+
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestResumeSkipsCommittedFragments(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	rangeRequests := &atomic.Int32{}
+	server := newTestServer(payload, serverConfig{etag: `"v1"`, ranged: rangeRequests})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "out.journal")
+	journal, err := OpenJournal(journalPath)
+	assert.NoError(t, err)
+	assert.NoError(t, journal.Reset(u.String(), `"v1"`, "", int64(len(payload))))
+	assert.NoError(t, journal.Commit(0, 8))
+	assert.NoError(t, journal.Close())
+
+	// The first fragment was committed, followed by a partial write of the second before we were interrupted.
+	out, err := os.Create(filepath.Join(dir, "out"))
+	assert.NoError(t, err)
+	defer out.Close()
+	_, err = out.Write([]byte("hello woXXX"))
+	assert.NoError(t, err)
+
+	g := NewGranger(u, WithFragmentSize(8), WithResumeJournal(journalPath))
+	n, err := g.WriteTo(out)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(payload)-8), n)
+
+	written, err := os.ReadFile(out.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, payload, written)
+	assert.Equal(t, int32(3), rangeRequests.Load())
+
+	_, err = os.Stat(journalPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestResumeRestartsWhenSourceChanged(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	rangeRequests := &atomic.Int32{}
+	server := newTestServer(payload, serverConfig{etag: `"v2"`, ranged: rangeRequests})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "out.journal")
+	journal, err := OpenJournal(journalPath)
+	assert.NoError(t, err)
+	assert.NoError(t, journal.Reset(u.String(), `"v1"`, "", int64(len(payload))))
+	assert.NoError(t, journal.Commit(0, 8))
+	assert.NoError(t, journal.Close())
+
+	out, err := os.Create(filepath.Join(dir, "out"))
+	assert.NoError(t, err)
+	defer out.Close()
+	_, err = out.Write([]byte("stale by"))
+	assert.NoError(t, err)
+
+	g := NewGranger(u, WithFragmentSize(8), WithResumeJournal(journalPath))
+	n, err := g.WriteTo(out)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(payload)), n)
+
+	written, err := os.ReadFile(out.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, payload, written)
+}
+
+func TestJournalIgnoresPartialLine(t *testing.T) {
+	journalPath := filepath.Join(t.TempDir(), "out.journal")
+	journal, err := OpenJournal(journalPath)
+	assert.NoError(t, err)
+	assert.NoError(t, journal.Reset("http://example.com", `"v1"`, "", 100))
+	assert.NoError(t, journal.Commit(0, 10))
+	assert.NoError(t, journal.Commit(20, 30))
+	assert.NoError(t, journal.Commit(10, 20))
+	_, err = journal.file.WriteString(`{"start":30,"en`)
+	assert.NoError(t, err)
+	assert.NoError(t, journal.Close())
+
+	journal, err = OpenJournal(journalPath)
+	assert.NoError(t, err)
+	defer journal.Close()
+
+	assert.True(t, journal.Matches("http://example.com", `"v1"`, "", 100))
+	assert.Equal(t, int64(30), journal.CommittedOffset())
+}
+
+func TestJournalGaps(t *testing.T) {
+	journalPath := filepath.Join(t.TempDir(), "out.journal")
+	journal, err := OpenJournal(journalPath)
+	assert.NoError(t, err)
+	defer journal.Close()
+
+	assert.Equal(t, []journalRange{{0, 100}}, journal.Gaps(100))
+
+	assert.NoError(t, journal.Reset("http://example.com", `"v1"`, "", 100))
+	assert.NoError(t, journal.Commit(60, 80))
+	assert.NoError(t, journal.Commit(10, 20))
+	assert.NoError(t, journal.Commit(15, 30))
+	assert.Equal(t, []journalRange{{0, 10}, {30, 60}, {80, 100}}, journal.Gaps(100))
+
+	assert.NoError(t, journal.Commit(0, 10))
+	assert.NoError(t, journal.Commit(30, 60))
+	assert.NoError(t, journal.Commit(80, 100))
+	assert.Empty(t, journal.Gaps(100))
+}
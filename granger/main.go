@@ -1,40 +1,321 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log"
+	"net/http"
 	"net/url"
 	"os"
-	"runtime"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
-	Parallelization = 5
-	MiB             = 1024 * 1024
-	FragmentSize    = 20 * MiB
+	MiB = 1024 * 1024
+
+	defaultCLIParallelization = 5
+	defaultCLIFragmentSize    = "20MiB"
+	defaultCLIRetries         = 3
+	defaultCLIRetryBackoff    = 500 * time.Millisecond
+)
+
+// Exit codes of the command.
+const (
+	exitOK               = 0
+	exitFailure          = 1
+	exitUsage            = 2
+	exitChecksumMismatch = 3
+	exitInterrupted      = 130
 )
 
+// cliConfig is what was asked for on the command line.
+type cliConfig struct {
+	url             *url.URL
+	output          string
+	parallelization int
+	fragmentSize    int64
+	rateLimit       int64
+	headers         http.Header
+	retries         int
+	retryBackoff    time.Duration
+	verify          bool
+	sha256          []byte
+	resume          bool
+	quiet           bool
+	logger          *log.Logger
+	manifest        string
+	summary         string
+}
+
 func main() {
-	flag.Parse()
-	args := flag.Args()
-	if len(args) != 1 {
-		fmt.Printf("usage: %s URL.\n", os.Args[0])
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// run runs the command with args, returning its exit code.
+func run(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	config, err := parseArgs(args, stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	if err != nil {
+		return exitUsage
+	}
+	if config.manifest != "" {
+		return runBatch(ctx, config, stdout, stderr)
 	}
 
-	uri, err := url.Parse(args[0])
+	options := config.options()
+	var bar *progressBar
+	if !config.quiet && isTerminal(stderr) {
+		bar = newProgressBar(stderr)
+		options = append(options, WithProgress(bar.Update))
+		go bar.Run(progressInterval)
+	}
+
+	if config.output == "-" {
+		_, err = NewGranger(config.url, options...).WriteToContext(ctx, stdout)
+	} else {
+		_, err = downloadFile(ctx, config.url, config.output, config.resume, options)
+	}
+	if bar != nil {
+		bar.Stop()
+	}
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(stderr, "granger: %v\n", err)
+		switch {
+		case ctx.Err() != nil:
+			return exitInterrupted
+		case errors.Is(err, ErrChecksumMismatch):
+			return exitChecksumMismatch
+		}
+		return exitFailure
 	}
+	return exitOK
+}
+
+// runBatch downloads every file in the manifest, then writes a JSON summary of how it went. The exit code is a
+// failure if any file failed.
+func runBatch(ctx context.Context, config *cliConfig, stdout io.Writer, stderr io.Writer) int {
+	var manifest io.Reader = os.Stdin
+	if config.manifest != "-" {
+		f, err := os.Open(config.manifest)
+		if err != nil {
+			fmt.Fprintf(stderr, "granger: %v\n", err)
+			return exitFailure
+		}
+		defer f.Close()
+		manifest = f
+	}
+	entries, err := ParseManifest(manifest)
+	if err != nil {
+		fmt.Fprintf(stderr, "granger: %v\n", err)
+		return exitFailure
+	}
+
+	batch := BatchConfig{
+		Concurrency:    config.parallelization,
+		BytesPerSecond: config.rateLimit,
+		Resume:         config.resume,
+		Options:        config.options(),
+	}
+	if config.output != "-" {
+		batch.Dir = config.output
+	}
+	summary := DownloadBatch(ctx, entries, batch)
 
-	granger := NewGranger(
-		uri,
-		WithParallelization(Parallelization),
-		WithFragmentSize(FragmentSize),
-	)
+	w := stdout
+	if config.summary != "" {
+		f, err := os.Create(config.summary)
+		if err != nil {
+			fmt.Fprintf(stderr, "granger: %v\n", err)
+			return exitFailure
+		}
+		defer f.Close()
+		w = f
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(summary); err != nil {
+		fmt.Fprintf(stderr, "granger: %v\n", err)
+		return exitFailure
+	}
 
-	runtime.GOMAXPROCS(runtime.NumCPU())
+	if !config.quiet {
+		for _, result := range summary.Results {
+			if result.Error != "" {
+				fmt.Fprintf(stderr, "granger: %v: %v\n", result.URL, result.Error)
+			}
+		}
+	}
+	switch {
+	case summary.Failed == 0:
+		return exitOK
+	case ctx.Err() != nil:
+		return exitInterrupted
+	}
+	return exitFailure
+}
 
-	if _, err := granger.WriteTo(os.Stdout); err != nil {
-		panic(err)
+// parseArgs parses the command line. If it is wrong, or -h is given, what was wrong and the usage are printed to
+// stderr.
+func parseArgs(args []string, stderr io.Writer) (*cliConfig, error) {
+	config := &cliConfig{headers: http.Header{}}
+	fs := flag.NewFlagSet("granger", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: granger [flags] URL\n       granger [flags] -manifest PATH\n\n"+
+			"Downloads URL, or every file listed in a manifest, in parallel fragments.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+
+	fragmentSize := fs.String("s", defaultCLIFragmentSize, "fragment `size`, in bytes or with a K, M or G suffix")
+	sha256 := fs.String("sha256", "", "expected SHA-256 of the download, in `hex`")
+	rateLimit := fs.String("limit", "", "limit the download to `rate` bytes per second, with a K, M or G suffix")
+	fs.StringVar(&config.output, "o", "-",
+		"write to `path` rather than stdout, or with -manifest the directory to save in")
+	fs.IntVar(&config.parallelization, "j", defaultCLIParallelization, "number of fragments to fetch at once")
+	fs.Var((*headerFlag)(&config.headers), "H", "add a request `header`, as \"Name: value\"; may be repeated")
+	fs.IntVar(&config.retries, "retries", defaultCLIRetries, "number of times to retry a failed fragment")
+	fs.DurationVar(&config.retryBackoff, "retry-backoff", defaultCLIRetryBackoff, "delay before the first retry")
+	fs.BoolVar(&config.verify, "verify", false, "verify checksums advertised by the server")
+	fs.BoolVar(&config.resume, "resume", false, "keep a journal so that an interrupted download can be resumed")
+	fs.BoolVar(&config.quiet, "q", false, "don't show a progress bar")
+	verbose := fs.Bool("v", false, "log each fragment as it is fetched")
+	fs.StringVar(&config.manifest, "manifest", "", "download every file listed in the manifest at `path`, or - for stdin")
+	fs.StringVar(&config.summary, "summary", "", "with -manifest, write the JSON summary to `path` rather than stdout")
+
+	if err := fs.Parse(args); err != nil {
+		// The flag package has already said what was wrong.
+		return nil, err
+	}
+	invalid := func(format string, args ...any) (*cliConfig, error) {
+		err := fmt.Errorf(format, args...)
+		fmt.Fprintln(stderr, err)
+		fs.Usage()
+		return nil, err
+	}
+	var err error
+	if config.manifest != "" {
+		if fs.NArg() != 0 {
+			return invalid("expected no URL with -manifest")
+		}
+		if *sha256 != "" {
+			return invalid("-sha256 can't be used with -manifest, give it for each file in the manifest instead")
+		}
+	} else {
+		if fs.NArg() != 1 {
+			return invalid("expected exactly one URL")
+		}
+		if config.url, err = url.Parse(fs.Arg(0)); err != nil {
+			return invalid("invalid URL: %v", err)
+		}
+		if config.url.Scheme != "http" && config.url.Scheme != "https" {
+			return invalid("unsupported URL %q, expected http or https", fs.Arg(0))
+		}
+		if config.summary != "" {
+			return invalid("-summary can only be used with -manifest")
+		}
+	}
+	if config.fragmentSize, err = parseSize(*fragmentSize); err != nil {
+		return invalid("invalid fragment size: %v", err)
+	}
+	if *rateLimit != "" {
+		if config.rateLimit, err = parseSize(*rateLimit); err != nil {
+			return invalid("invalid rate limit: %v", err)
+		}
+	}
+	if config.parallelization < 1 {
+		return invalid("invalid parallelism %v, must be at least 1", config.parallelization)
+	}
+	if config.retries < 0 {
+		return invalid("invalid retries %v, must not be negative", config.retries)
+	}
+	if *sha256 != "" {
+		if config.sha256, err = hex.DecodeString(*sha256); err != nil || len(config.sha256) != 32 {
+			return invalid("invalid SHA-256 %q", *sha256)
+		}
+	}
+	if config.resume && config.output == "-" && config.manifest == "" {
+		return invalid("-resume needs an output file, given with -o")
+	}
+	if *verbose {
+		config.logger = log.New(stderr, "granger: ", log.Ltime|log.Lmicroseconds)
+	}
+	return config, nil
+}
+
+// options returns the Granger options for the config.
+func (c *cliConfig) options() []Option {
+	options := []Option{
+		WithParallelization(c.parallelization),
+		WithFragmentSize(int(c.fragmentSize)),
+		WithRetryPolicy(c.retries+1, c.retryBackoff, 0.2),
+		WithRequestHeaders(c.headers),
+	}
+	if c.rateLimit > 0 && c.manifest == "" {
+		// A batch shares a single limit between every file instead.
+		options = append(options, WithRateLimit(c.rateLimit))
+	}
+	if c.logger != nil {
+		options = append(options, WithObserver(NewLogObserver(c.logger)))
+	}
+	if c.verify {
+		options = append(options, WithChecksumVerification())
+	}
+	if c.sha256 != nil {
+		options = append(options, WithExpectedDigest(AlgorithmSHA256, c.sha256))
+	}
+	return options
+}
+
+// headerFlag collects repeated -H flags.
+type headerFlag http.Header
+
+func (h *headerFlag) String() string {
+	return ""
+}
+
+func (h *headerFlag) Set(value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("expected \"Name: value\", got %q", value)
+	}
+	http.Header(*h).Add(name, strings.TrimSpace(v))
+	return nil
+}
+
+// parseSize parses a number of bytes, optionally followed by a K, M or G suffix (or KiB, MiB, GiB), all of which
+// are powers of 1024.
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.TrimSpace(s)
+	for suffix, m := range map[string]int64{"k": 1 << 10, "m": 1 << 20, "g": 1 << 30} {
+		lower := strings.ToLower(number)
+		if trimmed, ok := strings.CutSuffix(lower, suffix+"ib"); ok {
+			number, multiplier = trimmed, m
+			break
+		}
+		if trimmed, ok := strings.CutSuffix(lower, suffix); ok {
+			number, multiplier = trimmed, m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%q is not a positive size", s)
 	}
+	return n * multiplier, nil
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// runCLI runs the command with args, returning its exit code, stdout and stderr.
+func runCLI(args ...string) (int, []byte, string) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code := run(context.Background(), args, stdout, stderr)
+	return code, stdout.Bytes(), stderr.String()
+}
+
+func TestCLIUsage(t *testing.T) {
+	tests := map[string]struct {
+		args     []string
+		code     int
+		expected string
+	}{
+		"no url":             {args: nil, code: exitUsage, expected: "expected exactly one URL"},
+		"two urls":           {args: []string{"http://a", "http://b"}, code: exitUsage, expected: "usage: granger"},
+		"unknown flag":       {args: []string{"-x", "http://a"}, code: exitUsage, expected: "flag provided but not defined"},
+		"bad scheme":         {args: []string{"ftp://a"}, code: exitUsage, expected: "unsupported URL"},
+		"bad fragment size":  {args: []string{"-s", "big", "http://a"}, code: exitUsage, expected: "invalid fragment size"},
+		"bad rate limit":     {args: []string{"-limit", "fast", "http://a"}, code: exitUsage, expected: "invalid rate limit"},
+		"bad parallelism":    {args: []string{"-j", "0", "http://a"}, code: exitUsage, expected: "invalid parallelism"},
+		"bad header":         {args: []string{"-H", "nocolon", "http://a"}, code: exitUsage, expected: "Name: value"},
+		"bad sha256":         {args: []string{"-sha256", "abc", "http://a"}, code: exitUsage, expected: "invalid SHA-256"},
+		"resume to stdout":   {args: []string{"-resume", "http://a"}, code: exitUsage, expected: "-resume needs"},
+		"help":               {args: []string{"-h"}, code: exitOK, expected: "usage: granger"},
+		"unreachable server": {args: []string{"-q", "-retries", "0", "http://127.0.0.1:1"}, code: exitFailure},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			code, _, stderr := runCLI(test.args...)
+			assert.Equal(t, test.code, code)
+			assert.Contains(t, stderr, test.expected)
+		})
+	}
+}
+
+func TestCLIDownloadsToStdout(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := newTestServer(payload, serverConfig{})
+	defer server.Close()
+
+	code, stdout, stderr := runCLI("-j", "2", "-s", "8", "-limit", "10M", server.URL)
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, payload, stdout)
+	// Without a terminal there is no progress bar.
+	assert.Empty(t, stderr)
+}
+
+func TestCLIDownloadsToFile(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	sum := sha256.Sum256(payload)
+	server := newAuthServer(payload, func(r *http.Request) bool {
+		return r.Header.Get("X-Api-Key") == "secret"
+	})
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "out.bin")
+	code, stdout, stderr := runCLI("-o", output, "-s", "5", "-H", "X-Api-Key: secret", "-sha256",
+		hex.EncodeToString(sum[:]), "-resume", server.URL)
+	assert.Equal(t, exitOK, code, stderr)
+	assert.Empty(t, stdout)
+	data, err := os.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, data)
+	// The journal is removed once the download completes.
+	assert.NoFileExists(t, output+journalSuffix)
+}
+
+func TestCLIVerbose(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := newTestServer(payload, serverConfig{})
+	defer server.Close()
+
+	code, stdout, stderr := runCLI("-v", "-s", "8", server.URL)
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, payload, stdout)
+	assert.Contains(t, stderr, "fragment 16+8: attempt 1 completed")
+}
+
+func TestCLIChecksumMismatch(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := newTestServer(payload, serverConfig{})
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "out.bin")
+	code, _, stderr := runCLI("-o", output, "-sha256", hex.EncodeToString(make([]byte, 32)), server.URL)
+	assert.Equal(t, exitChecksumMismatch, code)
+	assert.Contains(t, stderr, "checksum mismatch")
+	assert.NoFileExists(t, output)
+}
+
+func TestCLIServerError(t *testing.T) {
+	server := newAuthServer(nil, func(r *http.Request) bool { return false })
+	defer server.Close()
+
+	code, _, stderr := runCLI("-retries", "0", server.URL)
+	assert.Equal(t, exitFailure, code)
+	assert.Contains(t, stderr, "granger: ")
+}
+
+func TestCLIManifest(t *testing.T) {
+	files := map[string][]byte{"a.bin": []byte("hello world"), "b.bin": []byte("hello granger")}
+	server := newFileServer(files, 0, &atomic.Int32{}, &atomic.Int32{})
+	defer server.Close()
+
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "manifest.txt")
+	assert.NoError(t, os.WriteFile(manifest,
+		[]byte(server.URL+"/a.bin\n"+server.URL+"/b.bin\n"+server.URL+"/c.bin\n"), 0644))
+
+	code, stdout, stderr := runCLI("-manifest", manifest, "-o", filepath.Join(dir, "out"), "-j", "2", "-retries", "0")
+	assert.Equal(t, exitFailure, code)
+	assert.Contains(t, stderr, "c.bin")
+
+	summary := &BatchSummary{}
+	assert.NoError(t, json.Unmarshal(stdout, summary))
+	assert.Equal(t, 2, summary.Succeeded)
+	assert.Equal(t, 1, summary.Failed)
+	assert.Equal(t, int64(24), summary.Bytes)
+	data, err := os.ReadFile(filepath.Join(dir, "out", "b.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, files["b.bin"], data)
+
+	code, _, stderr = runCLI("-manifest", manifest, "http://a")
+	assert.Equal(t, exitUsage, code)
+	assert.Contains(t, stderr, "expected no URL")
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"1":      1,
+		"4096":   4096,
+		"8k":     8 << 10,
+		"8KiB":   8 << 10,
+		"20MiB":  20 << 20,
+		"20m":    20 << 20,
+		" 2G ":   2 << 30,
+		"1gib":   1 << 30,
+		"0":      -1,
+		"-5":     -1,
+		"MiB":    -1,
+		"1.5MiB": -1,
+	}
+
+	for s, expected := range tests {
+		t.Run(s, func(t *testing.T) {
+			size, err := parseSize(s)
+			if expected < 0 {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, expected, size)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// defaultDurationBuckets are the upper bounds, in seconds, of the fragment duration histograms.
+	defaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+)
+
+// Metrics is an Observer which counts what downloads are doing, and serves the counts over HTTP in the Prometheus
+// text format, e.g. on /metrics. A single Metrics can observe any number of downloads.
+type Metrics struct {
+	fragmentsStarted   atomic.Int64
+	fragmentsSucceeded atomic.Int64
+	fragmentsFailed    atomic.Int64
+	fragmentsInFlight  atomic.Int64
+	retries            atomic.Int64
+	bytesFetched       atomic.Int64
+	bytesWritten       atomic.Int64
+	latency            *histogram
+	duration           *histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		latency:  newHistogram(defaultDurationBuckets),
+		duration: newHistogram(defaultDurationBuckets),
+	}
+}
+
+func (m *Metrics) FragmentStarted(ctx context.Context, fragment Fragment, attempt int) context.Context {
+	m.fragmentsStarted.Add(1)
+	m.fragmentsInFlight.Add(1)
+	return ctx
+}
+
+func (m *Metrics) FragmentCompleted(ctx context.Context, fragment Fragment, stats FragmentStats, err error) {
+	m.fragmentsInFlight.Add(-1)
+	if err != nil {
+		m.fragmentsFailed.Add(1)
+		return
+	}
+	m.fragmentsSucceeded.Add(1)
+	m.bytesFetched.Add(fragment.Size)
+	m.latency.Observe(stats.Latency.Seconds())
+	m.duration.Observe(stats.Elapsed.Seconds())
+}
+
+func (m *Metrics) Retry(fragment Fragment, attempt int, delay time.Duration, err error) {
+	m.retries.Add(1)
+}
+
+func (m *Metrics) BytesWritten(n, written, total int64) {
+	m.bytesWritten.Add(n)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = m.Write(w)
+}
+
+// Write writes the metrics to w in the Prometheus text format.
+func (m *Metrics) Write(w io.Writer) error {
+	metrics := []struct {
+		name, kind, help string
+		write            func(name string) string
+	}{
+		{"granger_fragments_started_total", "counter", "Attempts at fetching a fragment which have started.",
+			counter(&m.fragmentsStarted)},
+		{"granger_fragments_succeeded_total", "counter", "Attempts at fetching a fragment which succeeded.",
+			counter(&m.fragmentsSucceeded)},
+		{"granger_fragments_failed_total", "counter", "Attempts at fetching a fragment which failed.",
+			counter(&m.fragmentsFailed)},
+		{"granger_fragments_in_flight", "gauge", "Fragments being fetched right now.",
+			counter(&m.fragmentsInFlight)},
+		{"granger_fragment_retries_total", "counter", "Failed fragments which were retried.",
+			counter(&m.retries)},
+		{"granger_fetched_bytes_total", "counter", "Bytes fetched by fragments which succeeded.",
+			counter(&m.bytesFetched)},
+		{"granger_written_bytes_total", "counter", "Bytes written to destinations.",
+			counter(&m.bytesWritten)},
+		{"granger_fragment_latency_seconds", "histogram", "Time until the first byte of a fragment arrived.",
+			m.latency.format},
+		{"granger_fragment_duration_seconds", "histogram", "Time taken to fetch a whole fragment.",
+			m.duration.format},
+	}
+	for _, metric := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v", metric.name, metric.help, metric.name,
+			metric.kind, metric.write(metric.name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func counter(value *atomic.Int64) func(name string) string {
+	return func(name string) string {
+		return fmt.Sprintf("%v %v\n", name, value.Load())
+	}
+}
+
+// histogram counts observations into cumulative buckets, as Prometheus expects.
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds:  bounds,
+		buckets: make([]int64, len(bounds)),
+	}
+}
+
+func (h *histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.buckets[i] += 1
+		}
+	}
+	h.count += 1
+	h.sum += value
+}
+
+func (h *histogram) format(name string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := ""
+	for i, bound := range h.bounds {
+		s += fmt.Sprintf("%v_bucket{le=\"%v\"} %v\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+	}
+	s += fmt.Sprintf("%v_bucket{le=\"+Inf\"} %v\n", name, h.count)
+	s += fmt.Sprintf("%v_sum %v\n%v_count %v\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64), name, h.count)
+	return s
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := newFlakyServer(payload, 1, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	metrics := NewMetrics()
+	g := NewGranger(u, WithFragmentSize(8), WithRetryPolicy(3, time.Millisecond, 0), WithObserver(metrics))
+	_, err = g.WriteTo(&bytes.Buffer{})
+	assert.NoError(t, err)
+
+	exporter := httptest.NewServer(metrics)
+	defer exporter.Close()
+	resp, err := http.Get(exporter.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/plain; version=0.0.4", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	text := string(body)
+	for _, expected := range []string{
+		"# TYPE granger_fragments_started_total counter\ngranger_fragments_started_total 6\n",
+		"granger_fragments_succeeded_total 3\n",
+		"granger_fragments_failed_total 3\n",
+		"# TYPE granger_fragments_in_flight gauge\ngranger_fragments_in_flight 0\n",
+		"granger_fragment_retries_total 3\n",
+		"granger_fetched_bytes_total 24\n",
+		"granger_written_bytes_total 24\n",
+		"# TYPE granger_fragment_duration_seconds histogram\n",
+		"granger_fragment_duration_seconds_bucket{le=\"+Inf\"} 3\n",
+		"granger_fragment_latency_seconds_count 3\n",
+	} {
+		assert.Contains(t, text, expected)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+	assert.Equal(t, "h_bucket{le=\"0.1\"} 1\nh_bucket{le=\"1\"} 2\nh_bucket{le=\"+Inf\"} 3\nh_sum 2.55\nh_count 3\n",
+		h.format("h"))
+}
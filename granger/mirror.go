@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// scoreDecay is how much weight the latest observation of a mirror gets in its score.
+	scoreDecay = 0.3
+	// failurePenalty is what a mirror's score is multiplied by each time it fails.
+	failurePenalty = 0.25
+	// minScoreRatio is the smallest share of the best score that a mirror can drop to, so that a mirror which had a
+	// bad moment still gets picked occasionally and has a chance to recover.
+	minScoreRatio = 0.01
+)
+
+// mirror is a single endpoint serving the source.
+type mirror struct {
+	source Source
+	// score is a moving average of the throughput we've seen from this mirror in bytes per second. It is zero
+	// until the first fragment completes.
+	score    float64
+	failures int
+}
+
+// mirrorSet spreads fragments across several endpoints serving the same content, favouring the ones which have been
+// fastest and most reliable.
+type mirrorSet struct {
+	mu      sync.Mutex
+	mirrors []*mirror
+	rand    *rand.Rand
+}
+
+func newMirrorSet(sources []Source) *mirrorSet {
+	m := &mirrorSet{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, source := range sources {
+		m.mirrors = append(m.mirrors, &mirror{source: source})
+	}
+	return m
+}
+
+// Len returns the number of mirrors in the set.
+func (m *mirrorSet) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.mirrors)
+}
+
+// Pick chooses a mirror at random, weighted by score. The mirror given by exclude is only picked if it's the only
+// one left.
+func (m *mirrorSet) Pick(exclude *mirror) *mirror {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	candidates := make([]*mirror, 0, len(m.mirrors))
+	for _, mirror := range m.mirrors {
+		if mirror != exclude {
+			candidates = append(candidates, mirror)
+		}
+	}
+	if len(candidates) == 0 {
+		return exclude
+	}
+
+	weights := m.weights(candidates)
+	total := 0.0
+	for _, weight := range weights {
+		total += weight
+	}
+	n := m.rand.Float64() * total
+	for i, weight := range weights {
+		if n < weight {
+			return candidates[i]
+		}
+		n -= weight
+	}
+	return candidates[len(candidates)-1]
+}
+
+// weights returns the score of each mirror, giving mirrors we haven't measured yet the average so that they get
+// tried, and making sure no mirror drops out entirely.
+func (m *mirrorSet) weights(mirrors []*mirror) []float64 {
+	best, sum, measured := 0.0, 0.0, 0
+	for _, mirror := range mirrors {
+		if mirror.score > 0 {
+			best = max(best, mirror.score)
+			sum += mirror.score
+			measured += 1
+		}
+	}
+	if measured == 0 {
+		best, sum, measured = 1, 1, 1
+	}
+
+	weights := make([]float64, len(mirrors))
+	for i, mirror := range mirrors {
+		score := mirror.score
+		if score == 0 && mirror.failures == 0 {
+			score = sum / float64(measured)
+		}
+		weights[i] = max(score, best*minScoreRatio)
+	}
+	return weights
+}
+
+// Success records that the mirror served n bytes in elapsed.
+func (m *mirrorSet) Success(mirror *mirror, n int64, elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	throughput := float64(n) / elapsed.Seconds()
+	if mirror.score == 0 {
+		mirror.score = throughput
+	} else {
+		mirror.score = scoreDecay*throughput + (1-scoreDecay)*mirror.score
+	}
+	mirror.failures = 0
+}
+
+// Failure records that a request to the mirror failed.
+func (m *mirrorSet) Failure(mirror *mirror) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mirror.score *= failurePenalty
+	mirror.failures += 1
+}
+
+// Evict removes the mirror from the set, after an error which it would likely return for every fragment. The last
+// mirror is never evicted. It returns true if there are other mirrors to try instead, which is also the case if the
+// mirror was already evicted.
+func (m *mirrorSet) Evict(mirror *mirror) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.Index(m.mirrors, mirror)
+	if i < 0 {
+		return true
+	}
+	if len(m.mirrors) == 1 {
+		return false
+	}
+	m.mirrors = slices.Delete(m.mirrors, i, i+1)
+	return true
+}
+
+// newMirrorSet builds the set of mirrors for a download, made up of the primary source and every mirror which
+// serves the same content. A mirror is only used if its Content-Length matches the primary response, along with its
+// ETag if both have one, so that we never mix bytes from different versions of the source.
+func (r *Granger) newMirrorSet(ctx context.Context, info *sourceInfo) *mirrorSet {
+	sources := []Source{r.source}
+	for _, u := range r.mirrorUrls {
+		mirror := &httpSource{g: r, url: u, mirror: true}
+		if r.probeMirror(ctx, mirror, info.Size, info.ETag) {
+			sources = append(sources, mirror)
+		}
+	}
+	return newMirrorSet(sources)
+}
+
+func (r *Granger) probeMirror(ctx context.Context, mirror *httpSource, totalSize int64, etag string) bool {
+	resp, err := r.headRequest(ctx, mirror)
+	if err != nil {
+		return false
+	}
+
+	size, err := parseContentLength(resp)
+	if err != nil || size != totalSize {
+		return false
+	}
+	if mirrorEtag := resp.Header.Get("ETag"); etag != "" && mirrorEtag != "" && mirrorEtag != etag {
+		return false
+	}
+	return true
+}
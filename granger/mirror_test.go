@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMirrorsSpreadFragments(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	primaryRanged, mirrorRanged := &atomic.Int32{}, &atomic.Int32{}
+	primary := newTestServer(payload, serverConfig{etag: `"v1"`, ranged: primaryRanged})
+	defer primary.Close()
+	mirror := newTestServer(payload, serverConfig{etag: `"v1"`, ranged: mirrorRanged})
+	defer mirror.Close()
+
+	primaryUrl, _ := url.Parse(primary.URL)
+	mirrorUrl, _ := url.Parse(mirror.URL)
+
+	g := NewGranger(primaryUrl, WithFragmentSize(2), WithParallelization(3), WithMirrors(mirrorUrl))
+	buffer := &bytes.Buffer{}
+	_, err := g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, buffer.Bytes())
+	assert.Equal(t, int32(13), primaryRanged.Load()+mirrorRanged.Load())
+	assert.Greater(t, mirrorRanged.Load(), int32(0))
+}
+
+func TestMirrorsRetryOnAnotherMirror(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	// A mirror which errors is retried elsewhere, even when the error wouldn't be worth retrying on the same mirror.
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusNotFound, http.StatusForbidden} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			primaryRanged, mirrorRanged := &atomic.Int32{}, &atomic.Int32{}
+			primary := newTestServer(payload, serverConfig{etag: `"v1"`, ranged: primaryRanged})
+			defer primary.Close()
+			mirror := newTestServer(payload, serverConfig{etag: `"v1"`, ranged: mirrorRanged, failStatus: status})
+			defer mirror.Close()
+
+			primaryUrl, _ := url.Parse(primary.URL)
+			mirrorUrl, _ := url.Parse(mirror.URL)
+
+			// Without a retry policy, each fragment still gets one attempt per mirror.
+			g := NewGranger(primaryUrl, WithFragmentSize(4), WithParallelization(2), WithMirrors(mirrorUrl))
+			buffer := &bytes.Buffer{}
+			_, err := g.WriteTo(buffer)
+			assert.NoError(t, err)
+			assert.Equal(t, payload, buffer.Bytes())
+			assert.Equal(t, int32(7), primaryRanged.Load())
+			if status < 500 {
+				// The mirror is dropped after a client error, rather than being tried for every fragment.
+				assert.LessOrEqual(t, mirrorRanged.Load(), int32(2))
+			}
+		})
+	}
+}
+
+func TestMirrorSetEvict(t *testing.T) {
+	m := newMirrorSet([]Source{&httpSource{}, &httpSource{}})
+	first := m.Pick(nil)
+	assert.True(t, m.Evict(first))
+	assert.Equal(t, 1, m.Len())
+	for i := 0; i < 10; i++ {
+		assert.NotSame(t, first, m.Pick(nil))
+	}
+	// The last mirror is never evicted, so there is always somewhere to fetch from.
+	assert.False(t, m.Evict(m.Pick(nil)))
+	assert.Equal(t, 1, m.Len())
+	// Another fragment may find out about the same mirror afterwards.
+	assert.True(t, m.Evict(first))
+}
+
+func TestMirrorsWithDifferentContentAreSkipped(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	primaryRanged, staleRanged, shortRanged := &atomic.Int32{}, &atomic.Int32{}, &atomic.Int32{}
+	primary := newTestServer(payload, serverConfig{etag: `"v1"`, ranged: primaryRanged})
+	defer primary.Close()
+	stale := newTestServer([]byte("HELLO WORLD, GRANGER!!!!"), serverConfig{etag: `"v0"`, ranged: staleRanged})
+	defer stale.Close()
+	short := newTestServer([]byte("hello"), serverConfig{etag: `"v1"`, ranged: shortRanged})
+	defer short.Close()
+
+	primaryUrl, _ := url.Parse(primary.URL)
+	staleUrl, _ := url.Parse(stale.URL)
+	shortUrl, _ := url.Parse(short.URL)
+
+	g := NewGranger(primaryUrl, WithFragmentSize(2), WithParallelization(3), WithMirrors(staleUrl, shortUrl))
+	buffer := &bytes.Buffer{}
+	_, err := g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, buffer.Bytes())
+	assert.Equal(t, int32(0), staleRanged.Load())
+	assert.Equal(t, int32(0), shortRanged.Load())
+}
+
+func TestMirrorSetFavoursFastMirrors(t *testing.T) {
+	fast, _ := url.Parse("http://fast")
+	slow, _ := url.Parse("http://slow")
+	broken, _ := url.Parse("http://broken")
+	m := newMirrorSet([]Source{&httpSource{url: fast}, &httpSource{url: slow}, &httpSource{url: broken}})
+	m.rand = rand.New(rand.NewSource(1))
+
+	m.Success(m.mirrors[0], 100*MiB, time.Second)
+	m.Success(m.mirrors[1], 10*MiB, time.Second)
+	m.Failure(m.mirrors[2])
+
+	picks := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		picks[m.Pick(nil).source.(*httpSource).url.Host] += 1
+	}
+	assert.Greater(t, picks["fast"], picks["slow"])
+	assert.Greater(t, picks["slow"], picks["broken"])
+	assert.Greater(t, picks["broken"], 0)
+
+	// The excluded mirror is never picked while there are alternatives.
+	for i := 0; i < 100; i++ {
+		assert.NotEqual(t, m.mirrors[0], m.Pick(m.mirrors[0]))
+	}
+}
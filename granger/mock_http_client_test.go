@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// MockHTTPClient is an HTTPDoer which answers requests without a network, for tests. Each request is served by
+// Handler as though it had reached a server. A handler which panics with http.ErrAbortHandler has its connection
+// reset, as a real server would: the request fails if nothing was written yet, and the body is cut short otherwise.
+type MockHTTPClient struct {
+	Handler http.Handler
+	// DoFunc, if set, answers requests instead of Handler, e.g. to fail them with an error.
+	DoFunc func(req *http.Request) (*http.Response, error)
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func NewMockHTTPClient(handler http.Handler) *MockHTTPClient {
+	return &MockHTTPClient{Handler: handler}
+}
+
+func (m *MockHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	m.mu.Lock()
+	m.requests = append(m.requests, req)
+	m.mu.Unlock()
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	if m.DoFunc != nil {
+		return m.DoFunc(req)
+	}
+
+	w := &mockResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	aborted := serveMock(m.Handler, w, req)
+	if aborted && !w.wroteHeader {
+		return nil, io.ErrUnexpectedEOF
+	}
+	resp := w.Result()
+	resp.Request = req
+	if aborted {
+		resp.Body = io.NopCloser(io.MultiReader(resp.Body, errorReader{io.ErrUnexpectedEOF}))
+	}
+	return resp, nil
+}
+
+// Requests returns every request sent so far.
+func (m *MockHTTPClient) Requests() []*http.Request {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*http.Request{}, m.requests...)
+}
+
+// serveMock serves req with handler, returning true if the handler aborted with http.ErrAbortHandler.
+func serveMock(handler http.Handler, w http.ResponseWriter, req *http.Request) (aborted bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			err, ok := v.(error)
+			if !ok || !errors.Is(err, http.ErrAbortHandler) {
+				panic(v)
+			}
+			aborted = true
+		}
+	}()
+	handler.ServeHTTP(w, req)
+	return false
+}
+
+// mockResponseWriter records whether the handler got as far as sending the response header.
+type mockResponseWriter struct {
+	*httptest.ResponseRecorder
+	wroteHeader bool
+}
+
+func (w *mockResponseWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func (w *mockResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseRecorder.Write(b)
+}
+
+func (w *mockResponseWriter) Flush() {
+	w.wroteHeader = true
+	w.ResponseRecorder.Flush()
+}
+
+// errorReader fails every read with err.
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func TestMockHTTPClient(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	client := NewMockHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	}))
+	u, err := url.Parse("http://granger.test/payload")
+	assert.NoError(t, err)
+
+	buffer := &bytes.Buffer{}
+	_, err = NewGranger(u, WithHTTPClient(client), WithFragmentSize(8)).WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, buffer.Bytes())
+
+	ranges := []string{}
+	for _, req := range client.Requests() {
+		ranges = append(ranges, req.Header.Get("Range"))
+	}
+	assert.ElementsMatch(t, []string{"bytes=0-0", "bytes=0-7", "bytes=8-15", "bytes=16-23"}, ranges)
+}
+
+func TestMockHTTPClientDoFunc(t *testing.T) {
+	client := &MockHTTPClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		return nil, syscall.ECONNREFUSED
+	}}
+	u, err := url.Parse("http://granger.test/payload")
+	assert.NoError(t, err)
+
+	_, err = NewGranger(u, WithHTTPClient(client), WithRetryPolicy(2, time.Millisecond, 0)).WriteTo(&bytes.Buffer{})
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+	assert.Len(t, client.Requests(), 2)
+}
+
+func TestMockHTTPClientAbort(t *testing.T) {
+	client := NewMockHTTPClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/body" {
+			_, _ = w.Write([]byte("hello"))
+		}
+		panic(http.ErrAbortHandler)
+	}))
+
+	req, err := http.NewRequest(http.MethodGet, "http://granger.test/header", nil)
+	assert.NoError(t, err)
+	_, err = client.Do(req)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	req, err = http.NewRequest(http.MethodGet, "http://granger.test/body", nil)
+	assert.NoError(t, err)
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	assert.Equal(t, []byte("hello"), body)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Fragment identifies a fragment of the source in Observer events.
+type Fragment struct {
+	// Offset is the position of the first byte of the fragment in the source.
+	Offset int64
+	Size   int64
+}
+
+// FragmentStats describes an attempt at fetching a fragment.
+type FragmentStats struct {
+	// Attempt counts from 1 for the first attempt at the fragment.
+	Attempt int
+	// Latency is how long it took to receive the first byte, and Elapsed is how long the whole attempt took.
+	Latency time.Duration
+	Elapsed time.Duration
+}
+
+// Observer is told what a download is doing as it happens, e.g. to log it, export metrics or trace it. Its methods
+// are called from the goroutines doing the work, so must be safe for concurrent use and should return quickly.
+type Observer interface {
+	// FragmentStarted is called as each attempt at fetching a fragment starts. The context it returns is used for
+	// the attempt and passed to FragmentCompleted, so it can carry something like a tracing span.
+	FragmentStarted(ctx context.Context, fragment Fragment, attempt int) context.Context
+	// FragmentCompleted is called when an attempt at fetching a fragment finishes, with a nil err if it succeeded.
+	FragmentCompleted(ctx context.Context, fragment Fragment, stats FragmentStats, err error)
+	// Retry is called when an attempt at a fragment failed with err, and it will be tried again after delay.
+	Retry(fragment Fragment, attempt int, delay time.Duration, err error)
+	// BytesWritten is called when WriteTo or WriteToAt writes n bytes to the destination, with the number of bytes
+	// of the source written so far and its size, which is -1 if unknown.
+	BytesWritten(n, written, total int64)
+}
+
+// NopObserver does nothing. Embed it to implement only some of the Observer methods.
+type NopObserver struct{}
+
+func (NopObserver) FragmentStarted(ctx context.Context, fragment Fragment, attempt int) context.Context {
+	return ctx
+}
+
+func (NopObserver) FragmentCompleted(ctx context.Context, fragment Fragment, stats FragmentStats, err error) {
+}
+
+func (NopObserver) Retry(fragment Fragment, attempt int, delay time.Duration, err error) {}
+
+func (NopObserver) BytesWritten(n, written, total int64) {}
+
+// WithObserver tells observer about everything the download does. It can be given more than once, and every observer
+// is told in the order they were given.
+func WithObserver(observer Observer) Option {
+	return func(g *Granger) {
+		switch existing := g.observer.(type) {
+		case nil:
+			g.observer = observer
+		case multiObserver:
+			g.observer = append(existing, observer)
+		default:
+			g.observer = multiObserver{existing, observer}
+		}
+	}
+}
+
+// NewLogObserver returns an Observer which logs each attempt at a fragment, and each retry, to logger.
+func NewLogObserver(logger *log.Logger) Observer {
+	return logObserver{logger: logger}
+}
+
+type logObserver struct {
+	NopObserver
+	logger *log.Logger
+}
+
+func (l logObserver) FragmentStarted(ctx context.Context, fragment Fragment, attempt int) context.Context {
+	l.logger.Printf("fragment %v+%v: attempt %v started", fragment.Offset, fragment.Size, attempt)
+	return ctx
+}
+
+func (l logObserver) FragmentCompleted(ctx context.Context, fragment Fragment, stats FragmentStats, err error) {
+	if err != nil {
+		l.logger.Printf("fragment %v+%v: attempt %v failed after %v: %v", fragment.Offset, fragment.Size,
+			stats.Attempt, stats.Elapsed, err)
+		return
+	}
+	l.logger.Printf("fragment %v+%v: attempt %v completed in %v, first byte after %v", fragment.Offset,
+		fragment.Size, stats.Attempt, stats.Elapsed, stats.Latency)
+}
+
+func (l logObserver) Retry(fragment Fragment, attempt int, delay time.Duration, err error) {
+	l.logger.Printf("fragment %v+%v: retrying in %v", fragment.Offset, fragment.Size, delay)
+}
+
+// multiObserver passes every event on to each of its observers.
+type multiObserver []Observer
+
+func (m multiObserver) FragmentStarted(ctx context.Context, fragment Fragment, attempt int) context.Context {
+	for _, o := range m {
+		ctx = o.FragmentStarted(ctx, fragment, attempt)
+	}
+	return ctx
+}
+
+func (m multiObserver) FragmentCompleted(ctx context.Context, fragment Fragment, stats FragmentStats, err error) {
+	for _, o := range m {
+		o.FragmentCompleted(ctx, fragment, stats, err)
+	}
+}
+
+func (m multiObserver) Retry(fragment Fragment, attempt int, delay time.Duration, err error) {
+	for _, o := range m {
+		o.Retry(fragment, attempt, delay, err)
+	}
+}
+
+func (m multiObserver) BytesWritten(n, written, total int64) {
+	for _, o := range m {
+		o.BytesWritten(n, written, total)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingObserver remembers the events it is told about.
+type recordingObserver struct {
+	mu        sync.Mutex
+	started   []Fragment
+	completed []FragmentStats
+	failed    int
+	retries   []int
+	written   int64
+}
+
+func (o *recordingObserver) FragmentStarted(ctx context.Context, fragment Fragment, attempt int) context.Context {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.started = append(o.started, fragment)
+	return ctx
+}
+
+func (o *recordingObserver) FragmentCompleted(ctx context.Context, fragment Fragment, stats FragmentStats, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err != nil {
+		o.failed += 1
+		return
+	}
+	o.completed = append(o.completed, stats)
+}
+
+func (o *recordingObserver) Retry(fragment Fragment, attempt int, delay time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.retries = append(o.retries, attempt)
+}
+
+func (o *recordingObserver) BytesWritten(n, written, total int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.written += n
+}
+
+func TestObserver(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := newFlakyServer(payload, 1, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	first, second := &recordingObserver{}, &recordingObserver{}
+	g := NewGranger(u, WithFragmentSize(8), WithParallelization(2), WithRetryPolicy(3, time.Millisecond, 0),
+		WithObserver(first), WithObserver(second))
+	buffer := &bytes.Buffer{}
+	_, err = g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, buffer.Bytes())
+
+	for _, o := range []*recordingObserver{first, second} {
+		// Each fragment fails once and is retried.
+		assert.Len(t, o.started, 6)
+		assert.Equal(t, 3, o.failed)
+		assert.Equal(t, []int{1, 1, 1}, o.retries)
+		assert.Len(t, o.completed, 3)
+		for _, stats := range o.completed {
+			assert.Equal(t, 2, stats.Attempt)
+			assert.Greater(t, stats.Elapsed, time.Duration(0))
+			assert.LessOrEqual(t, stats.Latency, stats.Elapsed)
+		}
+		offsets := []int{}
+		for _, fragment := range o.started {
+			assert.Equal(t, int64(8), fragment.Size)
+			offsets = append(offsets, int(fragment.Offset))
+		}
+		sort.Ints(offsets)
+		assert.Equal(t, []int{0, 0, 8, 8, 16, 16}, offsets)
+		assert.Equal(t, int64(len(payload)), o.written)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import "fmt"
+
+// byteRange is an inclusive range of bytes of the source, as sent in a Range header.
+type byteRange struct {
+	first int64
+	last  int64
+}
+
+func (b byteRange) size() int64 {
+	return b.last - b.first + 1
+}
+
+func (b byteRange) String() string {
+	return fmt.Sprintf("bytes=%v-%v", b.first, b.last)
+}
+
+// fragmentPlanner splits the bytes of the source from start up to end into the ranges fetched by each fragment.
+// The size of each fragment is decided as it is planned, so that it can follow the tuner.
+type fragmentPlanner struct {
+	next int64
+	end  int64
+	// size returns the size of the fragment starting at next. Anything less than one plans the rest of the bytes as
+	// one fragment.
+	size func(next int64) int64
+}
+
+func newFragmentPlanner(start, end int64, size func(next int64) int64) *fragmentPlanner {
+	return &fragmentPlanner{
+		next: start,
+		end:  end,
+		size: size,
+	}
+}
+
+// Next returns the range of the next fragment, or false once every byte has been planned.
+func (p *fragmentPlanner) Next() (byteRange, bool) {
+	if p.next >= p.end {
+		return byteRange{}, false
+	}
+	size := p.size(p.next)
+	if size < 1 {
+		size = p.end - p.next
+	}
+	rng := byteRange{first: p.next, last: min(p.next+size, p.end) - 1}
+	p.next = rng.last + 1
+	return rng, true
+}
+
+// planFragments returns the ranges of every fragment of a source of totalSize bytes, split into fragments of
+// fragmentSize bytes. The last fragment holds whatever is left over, so may be smaller.
+func planFragments(totalSize, fragmentSize int64) []byteRange {
+	planner := newFragmentPlanner(0, totalSize, func(int64) int64 {
+		return fragmentSize
+	})
+	var ranges []byteRange
+	for rng, ok := planner.Next(); ok; rng, ok = planner.Next() {
+		ranges = append(ranges, rng)
+	}
+	return ranges
+}
+
+// fragmentSizer returns how big the next fragment should be. If the source is stored in parts, each fragment runs to
+// the end of the part it starts in. Otherwise it follows the tuner if there is one.
+func (r *Granger) fragmentSizer(tuner *tuner, parts []int64) func(next int64) int64 {
+	return func(next int64) int64 {
+		if len(parts) > 0 {
+			return partRemaining(parts, next)
+		}
+		if tuner != nil {
+			return int64(tuner.FragmentSize())
+		}
+		return int64(r.fragmentSize)
+	}
+}
+
+// partRemaining returns how many bytes of the part containing pos are left from pos onwards, or zero if pos is past
+// the last part.
+func partRemaining(parts []int64, pos int64) int64 {
+	end := int64(0)
+	for _, size := range parts {
+		end += size
+		if pos < end {
+			return end - pos
+		}
+	}
+	return 0
+}
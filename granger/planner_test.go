@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestPlanFragments(t *testing.T) {
+	tests := map[string]struct {
+		totalSize, fragmentSize int64
+		expected                []byteRange
+	}{
+		"empty":            {totalSize: 0, fragmentSize: 8},
+		"single byte":      {totalSize: 1, fragmentSize: 8, expected: []byteRange{{0, 0}}},
+		"exact multiple":   {totalSize: 16, fragmentSize: 8, expected: []byteRange{{0, 7}, {8, 15}}},
+		"tail":             {totalSize: 17, fragmentSize: 8, expected: []byteRange{{0, 7}, {8, 15}, {16, 16}}},
+		"bigger fragment":  {totalSize: 5, fragmentSize: 8, expected: []byteRange{{0, 4}}},
+		"no fragment size": {totalSize: 24, fragmentSize: 0, expected: []byteRange{{0, 23}}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, planFragments(test.totalSize, test.fragmentSize))
+		})
+	}
+}
+
+func TestFragmentPlannerVaryingSize(t *testing.T) {
+	sizes := []int64{3, 1, 10}
+	planner := newFragmentPlanner(2, 12, func(int64) int64 {
+		size := sizes[0]
+		sizes = sizes[1:]
+		return size
+	})
+
+	var ranges []byteRange
+	for rng, ok := planner.Next(); ok; rng, ok = planner.Next() {
+		ranges = append(ranges, rng)
+	}
+	assert.Equal(t, []byteRange{{2, 4}, {5, 5}, {6, 11}}, ranges)
+	assert.Equal(t, "bytes=6-11", ranges[2].String())
+}
+
+func TestPlanFragmentsCoversSource(t *testing.T) {
+	property := func(totalSize uint16, fragmentSize uint8) bool {
+		ranges := planFragments(int64(totalSize), int64(fragmentSize))
+		next := int64(0)
+		for _, rng := range ranges {
+			if rng.first != next || rng.last < rng.first {
+				return false
+			}
+			if fragmentSize > 0 && rng.size() > int64(fragmentSize) {
+				return false
+			}
+			next = rng.last + 1
+		}
+		return next == int64(totalSize)
+	}
+	assert.NoError(t, quick.Check(property, nil))
+}
+
+// newStrictServer serves payload, but unlike http.ServeContent it refuses ranges which run past the end of the
+// payload rather than quietly shortening them, and it records every range requested.
+func newStrictServer(t *testing.T, payload []byte) (*httptest.Server, func() []string) {
+	mu := sync.Mutex{}
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rng := r.Header.Get("Range")
+		if rng != "" {
+			mu.Lock()
+			requested = append(requested, rng)
+			mu.Unlock()
+
+			first, last, ok := strings.Cut(strings.TrimPrefix(rng, "bytes="), "-")
+			firstPos, err1 := strconv.Atoi(first)
+			lastPos, err2 := strconv.Atoi(last)
+			if !ok || err1 != nil || err2 != nil || lastPos < firstPos || lastPos >= len(payload) {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%v", len(payload)))
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, requested...)
+	}
+}
+
+// assertRangesCover checks that the fragments requested cover every byte of a source of size bytes exactly once.
+func assertRangesCover(t *testing.T, requested []string, size int) bool {
+	covered := make([]int, size)
+	probed := false
+	for _, rng := range requested {
+		if rng == "bytes=0-0" && !probed {
+			// The probe for range support.
+			probed = true
+			continue
+		}
+		var first, last int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &first, &last); err != nil {
+			return assert.Fail(t, "unexpected range", rng)
+		}
+		for i := first; i <= last; i++ {
+			covered[i]++
+		}
+	}
+	for i, n := range covered {
+		if n != 1 {
+			return assert.Fail(t, "byte fetched the wrong number of times", "byte %v fetched %v times", i, n)
+		}
+	}
+	return true
+}
+
+func TestFragmentBoundaries(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	property := func(size uint16, fragmentSize uint8, parallelization uint8) bool {
+		payload := make([]byte, int(size)%2000)
+		random.Read(payload)
+		options := []Option{
+			WithFragmentSize(int(fragmentSize)%64 + 1),
+			WithParallelization(int(parallelization)%4 + 1),
+		}
+
+		server, requested := newStrictServer(t, payload)
+		u, err := url.Parse(server.URL)
+		assert.NoError(t, err)
+
+		buffer := &bytes.Buffer{}
+		n, err := NewGranger(u, options...).WriteTo(buffer)
+		ok := assert.NoError(t, err) &&
+			assert.Equal(t, int64(len(payload)), n) &&
+			assert.True(t, bytes.Equal(payload, buffer.Bytes())) &&
+			assertRangesCover(t, requested(), len(payload))
+
+		server, requested = newStrictServer(t, payload)
+		u, err = url.Parse(server.URL)
+		assert.NoError(t, err)
+
+		w := &recordingWriterAt{}
+		n, err = NewGranger(u, options...).WriteToAt(w)
+		ok = ok && assert.NoError(t, err) &&
+			assert.Equal(t, int64(len(payload)), n) &&
+			assert.Equal(t, len(payload), len(w.data)) &&
+			assert.True(t, bytes.Equal(payload, w.data)) &&
+			assertRangesCover(t, requested(), len(payload))
+
+		reader, err := NewGranger(u, options...).Reader(context.Background())
+		assert.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		ok = ok && assert.NoError(t, err) && assert.True(t, bytes.Equal(payload, data))
+		assert.NoError(t, reader.Close())
+
+		if len(payload) > 0 {
+			f, err := NewGranger(u, append(options, WithBlockSize(int(fragmentSize)%16+1))...).Open(context.Background())
+			assert.NoError(t, err)
+			off := random.Intn(len(payload))
+			p := make([]byte, random.Intn(len(payload)-off)+1)
+			_, err = f.ReadAt(p, int64(off))
+			ok = ok && assert.NoError(t, err) && assert.Equal(t, payload[off:off+len(p)], p)
+			assert.NoError(t, f.Close())
+		}
+		return ok
+	}
+	assert.NoError(t, quick.Check(property, &quick.Config{MaxCount: 50}))
+}
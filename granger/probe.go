@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrRangeNotSupported is returned by Open when the source can't be fetched in ranges.
+	ErrRangeNotSupported = errors.New("granger: source does not support range requests")
+)
+
+// sourceInfo is what the initial request told us about the source.
+type sourceInfo struct {
+	ObjectInfo
+	// rangeable is true if the source can be fetched in fragments. Otherwise it has to be streamed with a single GET.
+	rangeable bool
+	// resp is the response to stream when the server ignored our range and sent the whole source. It is nil
+	// otherwise.
+	resp *http.Response
+}
+
+// probeRequest asks for the first byte of source to find out its size and whether the server supports ranges.
+func (r *Granger) probeRequest(ctx context.Context, source *httpSource) (*sourceInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := source.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		_ = resp.Body.Close()
+		first, last, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || first != 0 || last != 0 {
+			// We can't trust the server's ranges, so stream the whole source instead.
+			return &sourceInfo{ObjectInfo: ObjectInfo{Size: -1}}, nil
+		}
+		// Content-MD5 describes the byte we were sent rather than the whole source.
+		header := resp.Header.Clone()
+		header.Del("Content-MD5")
+		return &sourceInfo{ObjectInfo: objectInfo(header, total), rangeable: total >= 0}, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The source is empty, so it has no first byte to send.
+		_ = resp.Body.Close()
+		_, _, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || total != 0 {
+			return nil, newStatusError(resp)
+		}
+		return &sourceInfo{ObjectInfo: objectInfo(resp.Header, 0), rangeable: true}, nil
+	}
+	if !isSuccessResp(resp) {
+		_ = resp.Body.Close()
+		return nil, newStatusError(resp)
+	}
+
+	size, err := parseContentLength(resp)
+	if err != nil {
+		size = -1
+	}
+	return &sourceInfo{ObjectInfo: objectInfo(resp.Header, size), resp: resp}, nil
+}
+
+func objectInfo(header http.Header, size int64) ObjectInfo {
+	return ObjectInfo{
+		Size:         size,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+		Digests:      advertisedDigests(header),
+	}
+}
+
+// parseContentRange parses a Content-Range header such as "bytes 0-99/1000". The total is -1 if it is unknown, and
+// first and last are -1 if the header is for an unsatisfiable range, such as "bytes */1000".
+func parseContentRange(contentRange string) (first, last, total int64, err error) {
+	invalid := fmt.Errorf("invalid Content-Range %q", contentRange)
+	spec, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return 0, 0, 0, invalid
+	}
+	byteRange, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, invalid
+	}
+
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil || total < 0 {
+			return 0, 0, 0, invalid
+		}
+	}
+	if byteRange == "*" {
+		return -1, -1, total, nil
+	}
+
+	start, end, ok := strings.Cut(byteRange, "-")
+	if !ok {
+		return 0, 0, 0, invalid
+	}
+	if first, err = strconv.ParseInt(start, 10, 64); err != nil {
+		return 0, 0, 0, invalid
+	}
+	if last, err = strconv.ParseInt(end, 10, 64); err != nil || last < first || (total >= 0 && last >= total) {
+		return 0, 0, 0, invalid
+	}
+	return first, last, total, nil
+}
+
+// stream writes a source which can't be fetched in ranges to w with a single GET. Without ranges the download can't
+// be resumed or split into fragments, so the resume journal, mirrors and parallelization are all unused.
+func (r *Granger) stream(ctx context.Context, w io.Writer, info *sourceInfo) (int64, error) {
+	resp := info.resp
+	if resp == nil {
+		_, err := r.retryPolicy.Do(ctx, func() error {
+			var err error
+			resp, err = r.initRequest(ctx)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	defer resp.Body.Close()
+
+	size, err := parseContentLength(resp)
+	if err != nil {
+		// Without a Content-Length, e.g. with a chunked response, we read until the server closes the body.
+		size = -1
+	}
+
+	var verifier *verifier
+	if r.verifyChecksums || len(r.expectedDigests) > 0 {
+		if verifier, err = r.newVerifier(advertisedDigests(resp.Header), w, 0); err != nil {
+			return 0, err
+		}
+		w = io.MultiWriter(w, verifier)
+	}
+
+	w = r.limitWriter(ctx, w)
+	if progress := r.newProgress(0, size); progress != nil {
+		w = io.MultiWriter(w, progress)
+	}
+
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return n, err
+	}
+	if size >= 0 && n != size {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, r.verify(verifier, nil)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newStreamingServer ignores Range headers and always sends the whole payload, like a server without range support.
+func newStreamingServer(payload []byte, headers map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range headers {
+			w.Header().Set(k, v)
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(payload)))
+		_, _ = w.Write(payload)
+	}))
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := map[string]struct {
+		first, last, total int64
+		invalid            bool
+	}{
+		"bytes 0-0/24":    {first: 0, last: 0, total: 24},
+		"bytes 8-15/24":   {first: 8, last: 15, total: 24},
+		"bytes 0-0/*":     {first: 0, last: 0, total: -1},
+		"bytes */24":      {first: -1, last: -1, total: 24},
+		"bytes 0-24/24":   {invalid: true},
+		"bytes 9-8/24":    {invalid: true},
+		"bytes 0-8":       {invalid: true},
+		"items 0-8/24":    {invalid: true},
+		"bytes x-8/24":    {invalid: true},
+		"":                {invalid: true},
+		"bytes 0-0/-1":    {invalid: true},
+		"bytes 0-100/101": {first: 0, last: 100, total: 101},
+	}
+
+	for contentRange, test := range tests {
+		t.Run(contentRange, func(t *testing.T) {
+			first, last, total, err := parseContentRange(contentRange)
+			if test.invalid {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []int64{test.first, test.last, test.total}, []int64{first, last, total})
+		})
+	}
+}
+
+func TestWriteToStreamsWithoutRangeSupport(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	requests := &atomic.Int32{}
+	tests := map[string]http.HandlerFunc{
+		"range ignored": func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(payload)
+		},
+		"chunked": func(w http.ResponseWriter, r *http.Request) {
+			for _, chunk := range bytes.SplitAfter(payload, []byte(" ")) {
+				_, _ = w.Write(chunk)
+				w.(http.Flusher).Flush()
+			}
+		},
+		"unknown size": func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") != "" {
+				w.Header().Set("Content-Range", "bytes 0-0/*")
+				w.WriteHeader(http.StatusPartialContent)
+				_, _ = w.Write(payload[:1])
+				return
+			}
+			_, _ = w.Write(payload)
+		},
+	}
+
+	for name, handler := range tests {
+		t.Run(name, func(t *testing.T) {
+			requests.Store(0)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				handler(w, r)
+			}))
+			defer server.Close()
+
+			u, err := url.Parse(server.URL)
+			assert.NoError(t, err)
+
+			g := NewGranger(u, WithFragmentSize(5), WithParallelization(3))
+			buffer := &bytes.Buffer{}
+			n, err := g.WriteTo(buffer)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(payload)), n)
+			assert.Equal(t, payload, buffer.Bytes())
+			assert.LessOrEqual(t, requests.Load(), int32(2))
+
+			reader, err := g.Reader(context.Background())
+			assert.NoError(t, err)
+			data, err := io.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.NoError(t, reader.Close())
+			assert.Equal(t, payload, data)
+
+			_, err = g.Open(context.Background())
+			assert.ErrorIs(t, err, ErrRangeNotSupported)
+		})
+	}
+}
+
+func TestWriteToStreamDetectsTruncation(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(payload)))
+		_, _ = w.Write(payload[:10])
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	_, err = NewGranger(u).WriteTo(&bytes.Buffer{})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestWriteToEmptySource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(nil))
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	buffer := &bytes.Buffer{}
+	n, err := NewGranger(u, WithFragmentSize(8)).WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	assert.Equal(t, 0, buffer.Len())
+}
+
+func TestWriteToRejectsWrongContentRange(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rng := r.Header.Get("Range"); rng != "bytes=0-0" {
+			// Send the right number of bytes, but from the wrong place.
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-7/%v", len(payload)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(payload[:8])
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	g := NewGranger(u, WithFragmentSize(8), WithParallelization(2))
+	_, err = g.WriteTo(&bytes.Buffer{})
+	var rangeErr *RangeError
+	assert.True(t, errors.As(err, &rangeErr))
+	assert.Equal(t, http.StatusPartialContent, rangeErr.StatusCode)
+}
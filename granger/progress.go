@@ -0,0 +1,54 @@
+package main
+
+import "sync/atomic"
+
+// WithProgress calls progress each time WriteTo or WriteToAt writes bytes to the destination, with the number of
+// bytes of the source written so far and its size, which is -1 if the server didn't say. Bytes committed by an
+// earlier run of a resumed download count as written. progress may be called from several goroutines at once, and
+// should return quickly.
+func WithProgress(progress func(written, total int64)) Option {
+	return WithObserver(progressObserver{report: progress})
+}
+
+// progressObserver passes the bytes written on to a WithProgress callback.
+type progressObserver struct {
+	NopObserver
+	report func(written, total int64)
+}
+
+func (p progressObserver) BytesWritten(n, written, total int64) {
+	p.report(written, total)
+}
+
+// progress counts the bytes written by a download and tells the observer about them.
+type progress struct {
+	observer Observer
+	total    int64
+	written  atomic.Int64
+}
+
+// newProgress returns a progress for a source of total bytes of which written have already been written, or nil if
+// no one is listening.
+func (r *Granger) newProgress(written, total int64) *progress {
+	if r.observer == nil {
+		return nil
+	}
+	p := &progress{observer: r.observer, total: total}
+	p.written.Store(written)
+	p.observer.BytesWritten(0, written, total)
+	return p
+}
+
+// Add records that n more bytes were written.
+func (p *progress) Add(n int64) {
+	if p == nil {
+		return
+	}
+	p.observer.BytesWritten(n, p.written.Add(n), p.total)
+}
+
+// Write counts p as written, so that the progress can be tracked with an io.MultiWriter.
+func (p *progress) Write(b []byte) (int, error) {
+	p.Add(int64(len(b)))
+	return len(b), nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// progressInterval is how often the progress bar is redrawn.
+	progressInterval = 200 * time.Millisecond
+	// progressBarWidth is the number of characters between the brackets of the bar.
+	progressBarWidth = 30
+	// rateDecay is how much weight the latest interval gets in the throughput shown.
+	rateDecay = 0.3
+)
+
+// progressBar draws the progress of a download on a terminal, redrawing a single line with the throughput and ETA.
+type progressBar struct {
+	w       io.Writer
+	written atomic.Int64
+	total   atomic.Int64
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newProgressBar(w io.Writer) *progressBar {
+	b := &progressBar{
+		w:       w,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	b.total.Store(-1)
+	return b
+}
+
+// isTerminal returns true if w is a terminal, rather than a file or pipe.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Update records the progress of the download. It is passed to WithProgress.
+func (b *progressBar) Update(written, total int64) {
+	b.written.Store(written)
+	b.total.Store(total)
+}
+
+// Run redraws the bar every interval until Stop is called.
+func (b *progressBar) Run(interval time.Duration) {
+	defer close(b.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Bytes written before we started, e.g. by a resumed download, don't count towards the throughput.
+	last, lastTime := b.written.Load(), time.Now()
+	rate := 0.0
+	for {
+		select {
+		case <-b.stop:
+			fmt.Fprintf(b.w, "\r%v\n", renderProgress(b.written.Load(), b.total.Load(), rate))
+			return
+		case now := <-ticker.C:
+			written := b.written.Load()
+			instant := float64(written-last) / now.Sub(lastTime).Seconds()
+			if rate == 0 {
+				rate = instant
+			} else {
+				rate = rateDecay*instant + (1-rateDecay)*rate
+			}
+			last, lastTime = written, now
+			fmt.Fprintf(b.w, "\r%v", renderProgress(written, b.total.Load(), rate))
+		}
+	}
+}
+
+// Stop draws the bar a final time and moves on to the next line.
+func (b *progressBar) Stop() {
+	close(b.stop)
+	<-b.stopped
+}
+
+// renderProgress returns a line showing written out of total bytes at rate bytes per second. If total is unknown,
+// only the bytes written and the rate are shown.
+func renderProgress(written, total int64, rate float64) string {
+	speed := formatBytes(int64(rate)) + "/s"
+	if total < 0 {
+		return fmt.Sprintf("%v  %v", formatBytes(written), speed)
+	}
+
+	fraction := 1.0
+	if total > 0 {
+		fraction = min(float64(written)/float64(total), 1)
+	}
+	filled := int(fraction * progressBarWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+
+	eta := "--"
+	if rate > 0 {
+		eta = (time.Duration(float64(total-written)/rate) * time.Second).Round(time.Second).String()
+	}
+	return fmt.Sprintf("[%v] %3.0f%%  %v / %v  %v  ETA %v", bar, fraction*100, formatBytes(written),
+		formatBytes(total), speed, eta)
+}
+
+// formatBytes formats n bytes with a binary unit, e.g. 1.5 MiB.
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%v B", n)
+	}
+	value := float64(n)
+	unit := ""
+	for _, u := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= 1024
+		unit = u
+		if value < 1024 {
+			break
+		}
+	}
+	return fmt.Sprintf("%.1f %v", value, unit)
+}
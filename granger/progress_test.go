@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// progressRecorder records every call made to a WithProgress callback.
+type progressRecorder struct {
+	mu      sync.Mutex
+	written []int64
+	total   int64
+}
+
+func (p *progressRecorder) Update(written, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.written = append(p.written, written)
+	p.total = total
+}
+
+func TestWithProgress(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := newTestServer(payload, serverConfig{})
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	recorder := &progressRecorder{}
+	_, err = NewGranger(u, WithFragmentSize(8), WithParallelization(2), WithProgress(recorder.Update)).
+		WriteTo(&bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0, 8, 16, 24}, recorder.written)
+	assert.Equal(t, int64(24), recorder.total)
+
+	recorder = &progressRecorder{}
+	_, err = NewGranger(u, WithFragmentSize(8), WithParallelization(2), WithProgress(recorder.Update)).
+		WriteToAt(&recordingWriterAt{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(24), recorder.written[len(recorder.written)-1])
+
+	streaming := newStreamingServer(payload, map[string]string{})
+	defer streaming.Close()
+	u, err = url.Parse(streaming.URL)
+	assert.NoError(t, err)
+
+	recorder = &progressRecorder{}
+	_, err = NewGranger(u, WithProgress(recorder.Update)).WriteTo(&bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(24), recorder.written[len(recorder.written)-1])
+}
+
+func TestProgressBar(t *testing.T) {
+	tests := map[string]struct {
+		written, total int64
+		rate           float64
+		expected       string
+	}{
+		"start": {0, 100 * MiB, 0,
+			"[>                             ]   0%  0 B / 100.0 MiB  0 B/s  ETA --"},
+		"halfway": {50 * MiB, 100 * MiB, 10 * MiB,
+			"[===============>              ]  50%  50.0 MiB / 100.0 MiB  10.0 MiB/s  ETA 5s"},
+		"done": {100 * MiB, 100 * MiB, 10 * MiB,
+			"[==============================] 100%  100.0 MiB / 100.0 MiB  10.0 MiB/s  ETA 0s"},
+		"unknown size": {1536, -1, 512, "1.5 KiB  512 B/s"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, renderProgress(test.written, test.total, test.rate))
+		})
+	}
+
+	buffer := &syncBuffer{}
+	bar := newProgressBar(buffer)
+	go bar.Run(time.Millisecond)
+	bar.Update(5, 10)
+	time.Sleep(10 * time.Millisecond)
+	bar.Stop()
+	assert.Contains(t, buffer.String(), "\r[")
+	assert.Contains(t, buffer.String(), " 50%  5 B / 10 B")
+	assert.Equal(t, byte('\n'), buffer.Bytes()[buffer.Len()-1])
+}
+
+// syncBuffer is a bytes.Buffer which is safe to write from one goroutine while another reads it.
+type syncBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Bytes()
+}
+
+func (b *syncBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Len()
+}
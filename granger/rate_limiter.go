@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// rateLimiterBurst is how long the limiter lets bytes build up for while nothing is being read, so that a pause
+	// isn't followed by a burst far above the limit.
+	rateLimiterBurst = 100 * time.Millisecond
+	// minRateLimiterBurst is the smallest burst allowed, so that a low limit doesn't split every write into tiny
+	// pieces.
+	minRateLimiterBurst = 32 * 1024
+)
+
+// RateLimiter is a token bucket which limits the bytes read by every fragment sharing it to a number of bytes per
+// second. The rate can be changed while downloads are using it.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	// changed is closed and replaced whenever the rate changes, to wake up anyone waiting on the old rate.
+	changed chan struct{}
+}
+
+// NewRateLimiter returns a limiter allowing bytesPerSec bytes per second. Zero or less means unlimited.
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	l := &RateLimiter{now: time.Now, changed: make(chan struct{})}
+	l.last = l.now()
+	l.setRate(bytesPerSec)
+	l.tokens = l.burst
+	return l
+}
+
+// SetRate changes the limit to bytesPerSec bytes per second. Zero or less removes the limit.
+func (l *RateLimiter) SetRate(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	l.setRate(bytesPerSec)
+	l.tokens = min(l.tokens, l.burst)
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Rate returns the limit in bytes per second, or zero if there is none.
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(max(l.rate, 0))
+}
+
+func (l *RateLimiter) setRate(bytesPerSec int64) {
+	l.rate = float64(bytesPerSec)
+	l.burst = max(l.rate*rateLimiterBurst.Seconds(), minRateLimiterBurst)
+}
+
+// refill adds the tokens which have built up since it was last called. It must be called with mu held.
+func (l *RateLimiter) refill() {
+	now := l.now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.burst)
+	l.last = now
+}
+
+// WaitN blocks until n bytes may be read, or ctx is done.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	for n > 0 {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		l.refill()
+		chunk := min(float64(n), l.burst)
+		if l.tokens >= chunk {
+			l.tokens -= chunk
+			l.mu.Unlock()
+			n -= int(chunk)
+			continue
+		}
+		wait := time.Duration((chunk - l.tokens) / l.rate * float64(time.Second))
+		changed := l.changed
+		l.mu.Unlock()
+
+		// Wait until there should be enough tokens, or the rate changes, and then try again.
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// WithRateLimit limits the bytes read by all of the fragments together to bytesPerSec bytes per second. The limit can
+// be changed while downloading with SetRateLimit.
+func WithRateLimit(bytesPerSec int64) Option {
+	return func(g *Granger) {
+		g.rateLimiter = NewRateLimiter(bytesPerSec)
+	}
+}
+
+// WithRateLimiter limits the bytes read by every fragment to limiter, which may be shared with other downloads so
+// that they are limited together.
+func WithRateLimiter(limiter *RateLimiter) Option {
+	return func(g *Granger) {
+		g.rateLimiter = limiter
+	}
+}
+
+// SetRateLimit changes the rate limit to bytesPerSec bytes per second, including for fragments already being
+// fetched. Zero or less removes the limit.
+func (r *Granger) SetRateLimit(bytesPerSec int64) {
+	r.rateLimiter.SetRate(bytesPerSec)
+}
+
+// rateLimitedWriter waits for the limiter before each write.
+type rateLimitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *RateLimiter
+}
+
+func (r *rateLimitedWriter) Write(p []byte) (int, error) {
+	if err := r.limiter.WaitN(r.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return r.w.Write(p)
+}
+
+// limitWriter returns w, rate limited by the rate limiter.
+func (r *Granger) limitWriter(ctx context.Context, w io.Writer) io.Writer {
+	return &rateLimitedWriter{ctx: ctx, w: w, limiter: r.rateLimiter}
+}
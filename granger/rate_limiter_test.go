@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWaitN(t *testing.T) {
+	limiter := NewRateLimiter(1024 * 1024)
+	start := time.Now()
+	// The first 100 KiB are already in the bucket, the rest take 200ms.
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, limiter.WaitN(context.Background(), 30*1024))
+	}
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, 180*time.Millisecond)
+	assert.Less(t, elapsed, time.Second)
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	limiter := NewRateLimiter(0)
+	assert.Equal(t, int64(0), limiter.Rate())
+	// Without a limit nothing waits.
+	start := time.Now()
+	assert.NoError(t, limiter.WaitN(context.Background(), 100*1024*1024))
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+
+	limiter.SetRate(64 * 1024)
+	assert.Equal(t, int64(64*1024), limiter.Rate())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, limiter.WaitN(ctx, 1024*1024), context.DeadlineExceeded)
+
+	limiter.SetRate(0)
+	assert.NoError(t, limiter.WaitN(context.Background(), 1024*1024))
+}
+
+func TestWithRateLimit(t *testing.T) {
+	payload := make([]byte, 256*1024)
+	server := newTestServer(payload, serverConfig{})
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	g := NewGranger(u, WithFragmentSize(32*1024), WithParallelization(4), WithRateLimit(64*1024))
+	// At 64 KiB/s this would take seconds, so lift the limit once it has started.
+	time.AfterFunc(100*time.Millisecond, func() {
+		g.SetRateLimit(0)
+	})
+	start := time.Now()
+	buffer := &bytes.Buffer{}
+	_, err = g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, buffer.Bytes())
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, 100*time.Millisecond)
+	assert.Less(t, elapsed, 2*time.Second)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"pipeline"
+	"sync"
+)
+
+var (
+	// ErrReaderClosed is returned when reading from a Reader which has been closed.
+	ErrReaderClosed = errors.New("granger: read from closed reader")
+)
+
+// prefetch is a fragment which has been scheduled ahead of the reader.
+type prefetch struct {
+	fragment *HttpFragment
+	buffer   *bytes.Buffer
+	// done is closed once the fragment has been fetched, or failed with err.
+	done chan struct{}
+	err  error
+}
+
+// Reader streams the source in order, fetching upcoming fragments in parallel while the caller reads.
+type Reader struct {
+	g         *Granger
+	ctx       context.Context
+	cancel    context.CancelFunc
+	d         *download
+	semaphore *pipeline.Semaphore
+	verifier  *verifier
+	totalSize int64
+	// body is set instead when the source can't be fetched in ranges, and is read directly.
+	body    io.ReadCloser
+	planner *fragmentPlanner
+	// pending is a fragment which has been planned, but couldn't be scheduled yet for lack of a buffer.
+	pending *byteRange
+	// read is how much has been read from body.
+	read int64
+	// queue holds scheduled fragments in the order they will be read.
+	queue   []*prefetch
+	current *prefetch
+	wg      sync.WaitGroup
+	// err is returned by every Read once a fragment has failed.
+	err    error
+	closed bool
+}
+
+// WithPrefetchDepth sets how many fragments a Reader schedules ahead of the one being read. Up to the parallelization
+// of them are fetched at once. Defaults to the parallelization.
+func WithPrefetchDepth(depth int) Option {
+	return func(g *Granger) {
+		g.prefetchDepth = depth
+	}
+}
+
+// Reader returns an io.ReadCloser which streams the source in order. Upcoming fragments are prefetched in parallel
+// while the caller reads. Closing the reader cancels any requests in flight.
+func (r *Granger) Reader(ctx context.Context) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	info, err := r.stat(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	var body io.ReadCloser
+	if !info.rangeable {
+		// Without ranges we can only read the source from start to end, so we read a single response instead.
+		resp := info.resp
+		if resp == nil {
+			_, err = r.retryPolicy.Do(ctx, func() error {
+				resp, err = r.initRequest(ctx)
+				return err
+			})
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+		}
+		body = resp.Body
+		info.Digests = advertisedDigests(resp.Header)
+		if info.Size, err = parseContentLength(resp); err != nil {
+			info.Size = -1
+		}
+	}
+
+	var verifier *verifier
+	if r.verifyChecksums || len(r.expectedDigests) > 0 {
+		if verifier, err = r.newVerifier(info.Digests, nil, 0); err != nil {
+			if body != nil {
+				_ = body.Close()
+			}
+			cancel()
+			return nil, err
+		}
+	}
+
+	reader := &Reader{
+		g:         r,
+		ctx:       ctx,
+		cancel:    cancel,
+		semaphore: pipeline.NewSemaphore(r.parallelization),
+		verifier:  verifier,
+		totalSize: info.Size,
+		body:      body,
+	}
+	if body != nil {
+		return reader, nil
+	}
+	reader.d = &download{
+		mirrors: r.newMirrorSet(ctx, info),
+		buffers: newBufferPool(r.maxBuffered),
+	}
+	if r.adaptivePolicy != nil {
+		fragmentSize := r.fragmentSize
+		if fragmentSize == 0 {
+			fragmentSize = int(info.Size)
+		}
+		reader.d.tuner = newTuner(*r.adaptivePolicy, fragmentSize, r.parallelization, reader.semaphore.SetLimit)
+	}
+	reader.planner = newFragmentPlanner(0, info.Size, r.fragmentSizer(reader.d.tuner, info.Parts))
+	reader.schedule()
+
+	return reader, nil
+}
+
+func (r *Reader) prefetchDepth() int {
+	if r.g.prefetchDepth > 0 {
+		return r.g.prefetchDepth
+	}
+	if r.d.tuner != nil {
+		return r.d.tuner.Parallelization()
+	}
+	return r.g.parallelization
+}
+
+// schedule fills the queue up to the prefetch depth, or until there's no room left under the buffer ceiling. Buffers
+// are only reserved here, in order, so the fragment being waited on always has one.
+func (r *Reader) schedule() {
+	for len(r.queue) < r.prefetchDepth() {
+		if r.pending == nil {
+			rng, ok := r.planner.Next()
+			if !ok {
+				break
+			}
+			r.pending = &rng
+		}
+		buffer, ok := r.d.buffers.TryGet(int(r.pending.size()))
+		if !ok {
+			break
+		}
+		p := &prefetch{
+			buffer:   buffer,
+			fragment: newHttpFragment(r.g.srcUrl, *r.pending),
+			done:     make(chan struct{}),
+		}
+		r.queue = append(r.queue, p)
+		r.pending = nil
+
+		r.wg.Add(1)
+		go r.fetch(p)
+	}
+}
+
+func (r *Reader) fetch(p *prefetch) {
+	defer r.wg.Done()
+	defer close(p.done)
+
+	if err := r.semaphore.AcquireContext(r.ctx); err != nil {
+		p.err = err
+		return
+	}
+	defer r.semaphore.Release()
+
+	p.err = r.g.fetchFragment(r.ctx, p.fragment, p.buffer, r.d)
+}
+
+// Read reads the next bytes of the source, waiting for the fragment they are in to arrive if it hasn't already.
+func (r *Reader) Read(b []byte) (int, error) {
+	if r.closed {
+		return 0, ErrReaderClosed
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.body != nil {
+		return r.readBody(b)
+	}
+	for r.current == nil || r.current.buffer.Len() == 0 {
+		r.release()
+		r.schedule()
+		if len(r.queue) == 0 {
+			if r.verifier != nil {
+				if err := r.verifier.Verify(); err != nil {
+					r.err = err
+					return 0, err
+				}
+			}
+			return 0, io.EOF
+		}
+
+		p := r.queue[0]
+		select {
+		case <-p.done:
+		case <-r.ctx.Done():
+			r.err = r.ctx.Err()
+			return 0, r.err
+		}
+		r.queue = r.queue[1:]
+		r.current = p
+		r.schedule()
+		if p.err != nil {
+			r.err = p.err
+			return 0, p.err
+		}
+	}
+
+	n, _ := r.current.buffer.Read(b)
+	if r.verifier != nil {
+		_, _ = r.verifier.Write(b[:n])
+	}
+	return n, nil
+}
+
+// readBody reads from the response body of a source which can't be fetched in ranges.
+func (r *Reader) readBody(b []byte) (int, error) {
+	n, err := r.body.Read(b)
+	if r.verifier != nil {
+		_, _ = r.verifier.Write(b[:n])
+	}
+	r.read += int64(n)
+	if err == io.EOF {
+		if r.totalSize >= 0 && r.read != r.totalSize {
+			err = io.ErrUnexpectedEOF
+		} else if r.verifier != nil {
+			if verifyErr := r.verifier.Verify(); verifyErr != nil {
+				err = verifyErr
+			}
+		}
+	}
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// release returns the buffer of the fragment we've finished reading.
+func (r *Reader) release() {
+	if r.current != nil && r.current.buffer != nil {
+		r.d.buffers.Put(r.current.buffer, r.current.fragment.endPos-r.current.fragment.startPos)
+	}
+	r.current = nil
+}
+
+// Close cancels any fragments which are still being fetched, and waits for them to stop.
+func (r *Reader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.cancel()
+	r.wg.Wait()
+	if r.body != nil {
+		_ = r.body.Close()
+	}
+	return nil
+}
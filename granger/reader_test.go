@@ -0,0 +1,137 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReader(t *testing.T) {
+	payload := make([]byte, 1000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	server := newTestServer(payload, serverConfig{})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	tests := map[string][]Option{
+		"serial":               {WithFragmentSize(64)},
+		"parallel":             {WithFragmentSize(64), WithParallelization(4)},
+		"deep prefetch":        {WithFragmentSize(64), WithParallelization(2), WithPrefetchDepth(8)},
+		"uneven fragments":     {WithFragmentSize(77), WithParallelization(3)},
+		"single fragment":      {},
+		"bounded memory":       {WithFragmentSize(64), WithParallelization(4), WithMaxBufferedBytes(64)},
+		"prefetch beyond size": {WithFragmentSize(600), WithParallelization(4)},
+	}
+	for name, options := range tests {
+		t.Run(name, func(t *testing.T) {
+			reader, err := NewGranger(u, options...).Reader(context.Background())
+			assert.NoError(t, err)
+			defer reader.Close()
+
+			// Read in small, odd sized chunks so that reads span fragment boundaries.
+			read := &bytes.Buffer{}
+			_, err = io.CopyBuffer(read, struct{ io.Reader }{reader}, make([]byte, 13))
+			assert.NoError(t, err)
+			assert.Equal(t, payload, read.Bytes())
+		})
+	}
+}
+
+func TestReaderFeedsTar(t *testing.T) {
+	archive := &bytes.Buffer{}
+	tw := tar.NewWriter(archive)
+	contents := bytes.Repeat([]byte("granger"), 500)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "granger.txt", Mode: 0644, Size: int64(len(contents))}))
+	_, err := tw.Write(contents)
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+
+	sum := sha256.Sum256(archive.Bytes())
+	server := newTestServer(archive.Bytes(), serverConfig{})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	g := NewGranger(u, WithFragmentSize(512), WithParallelization(3), WithExpectedDigest(AlgorithmSHA256, sum[:]))
+	reader, err := g.Reader(context.Background())
+	assert.NoError(t, err)
+	defer reader.Close()
+
+	tr := tar.NewReader(reader)
+	header, err := tr.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "granger.txt", header.Name)
+	read, err := io.ReadAll(tr)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, read)
+}
+
+func TestReaderChecksumMismatch(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := newTestServer(payload, serverConfig{})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	g := NewGranger(u, WithFragmentSize(8), WithExpectedDigest(AlgorithmSHA256, []byte("nope")))
+	reader, err := g.Reader(context.Background())
+	assert.NoError(t, err)
+	defer reader.Close()
+
+	_, err = io.ReadAll(reader)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestReaderCloseCancelsRequests(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	received, cancelled := &atomic.Int32{}, &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rng := r.Header.Get("Range"); rng != "" && !strings.HasPrefix(rng, "bytes=0-") {
+			received.Add(1)
+			// Hang until the client gives up.
+			<-r.Context().Done()
+			cancelled.Add(1)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	reader, err := NewGranger(u, WithFragmentSize(8), WithParallelization(2)).Reader(context.Background())
+	assert.NoError(t, err)
+
+	first := make([]byte, 8)
+	_, err = io.ReadFull(reader, first)
+	assert.NoError(t, err)
+	assert.Equal(t, payload[:8], first)
+
+	// Wait for the next two fragments to be requested before giving up on them.
+	assert.Eventually(t, func() bool {
+		return received.Load() == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, reader.Close())
+	_, err = reader.Read(first)
+	assert.ErrorIs(t, err, ErrReaderClosed)
+	assert.Eventually(t, func() bool {
+		return cancelled.Load() == 2
+	}, time.Second, 10*time.Millisecond)
+}
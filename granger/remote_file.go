@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"pipeline"
+	"sync"
+)
+
+const (
+	defaultBlockSize      = 1 * MiB
+	defaultBlockCacheSize = 64
+	defaultMaxReadAhead   = 8
+	// maxCoalescedBlocks caps how many adjacent blocks are fetched by a single request, so that large reads are
+	// still fetched in parallel.
+	maxCoalescedBlocks = 16
+)
+
+var (
+	// ErrInvalidSeek is returned when seeking to a negative offset.
+	ErrInvalidSeek = errors.New("granger: seek to negative offset")
+)
+
+// WithBlockSize sets the size of the blocks a RemoteFile fetches and caches. Defaults to 1 MiB, which is also used
+// in place of a size of 0 or less.
+func WithBlockSize(blockSize int) Option {
+	return func(g *Granger) {
+		g.blockSize = blockSize
+	}
+}
+
+// WithBlockCacheSize sets how many blocks a RemoteFile keeps cached. Defaults to 64.
+func WithBlockCacheSize(blocks int) Option {
+	return func(g *Granger) {
+		g.blockCacheSize = blocks
+	}
+}
+
+// WithReadAhead sets the most blocks a RemoteFile fetches ahead of a sequential reader. Defaults to 8, and 0
+// disables read ahead.
+func WithReadAhead(blocks int) Option {
+	return func(g *Granger) {
+		g.maxReadAhead = blocks
+	}
+}
+
+// blockFetch is a block which is being fetched. Readers needing the block wait on done rather than fetching it again.
+type blockFetch struct {
+	index int64
+	done  chan struct{}
+	data  []byte
+	err   error
+}
+
+// RemoteFile provides random access to the source, turning reads into ranged GETs. The source is split into blocks
+// which are kept in an LRU cache. Adjacent blocks missing from the cache are fetched with a single request, and
+// blocks are fetched ahead of readers which are reading sequentially.
+type RemoteFile struct {
+	g         *Granger
+	ctx       context.Context
+	cancel    context.CancelFunc
+	d         *download
+	semaphore *pipeline.Semaphore
+	size      int64
+	blockSize int64
+
+	mu       sync.Mutex
+	cache    *blockCache
+	inflight map[int64]*blockFetch
+	// offset is where the next call to Read reads from.
+	offset int64
+	// lastEnd is where the previous read finished, which tells us whether reads are sequential.
+	lastEnd int64
+	// readAhead is the number of blocks currently being fetched ahead. It doubles with each sequential read.
+	readAhead int
+	wg        sync.WaitGroup
+}
+
+// Open returns a RemoteFile for random access to the source. The source is not read until the RemoteFile is.
+// ErrRangeNotSupported is returned if the server can't send ranges of the source.
+func (r *Granger) Open(ctx context.Context) (*RemoteFile, error) {
+	info, err := r.stat(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !info.rangeable {
+		if info.resp != nil {
+			_ = info.resp.Body.Close()
+		}
+		return nil, ErrRangeNotSupported
+	}
+	size := info.Size
+	blockSize := r.blockSize
+	if blockSize <= 0 {
+		blockSize = defaultBlockSize
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return &RemoteFile{
+		g:      r,
+		ctx:    ctx,
+		cancel: cancel,
+		d: &download{
+			mirrors: r.newMirrorSet(ctx, info),
+		},
+		semaphore: pipeline.NewSemaphore(r.parallelization),
+		size:      size,
+		blockSize: int64(blockSize),
+		cache:     newBlockCache(r.blockCacheSize),
+		inflight:  map[int64]*blockFetch{},
+	}, nil
+}
+
+// Size returns the size of the source.
+func (f *RemoteFile) Size() int64 {
+	return f.size
+}
+
+// ReadAt implements io.ReaderAt. It is safe to call concurrently.
+func (f *RemoteFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrInvalidSeek
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	end := min(off+int64(len(p)), f.size)
+	first, last := off/f.blockSize, (end-1)/f.blockSize
+
+	f.readAheadFrom(off, end, last)
+	blocks, err := f.blocks(first, last)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i := first; i <= last; i++ {
+		block := blocks[i-first]
+		start := max(off-i*f.blockSize, 0)
+		n += copy(p[n:], block[start:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read implements io.Reader, reading from the current offset.
+func (f *RemoteFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	offset := f.offset
+	f.mu.Unlock()
+
+	n, err := f.ReadAt(p, offset)
+	if n > 0 && err == io.EOF {
+		// io.Reader allows us to return the EOF on the next call instead.
+		err = nil
+	}
+
+	f.mu.Lock()
+	f.offset = offset + int64(n)
+	f.mu.Unlock()
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (f *RemoteFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return f.offset, ErrInvalidSeek
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Close cancels any blocks which are still being fetched.
+func (f *RemoteFile) Close() error {
+	f.cancel()
+	f.wg.Wait()
+	return nil
+}
+
+// blocks returns the data for every block from first to last, fetching any which aren't cached.
+func (f *RemoteFile) blocks(first, last int64) ([][]byte, error) {
+	blocks := make([][]byte, last-first+1)
+	var owned, waiting []*blockFetch
+
+	f.mu.Lock()
+	for i := first; i <= last; i++ {
+		if data, ok := f.cache.Get(i); ok {
+			blocks[i-first] = data
+			continue
+		}
+		if fetch, ok := f.inflight[i]; ok {
+			waiting = append(waiting, fetch)
+			continue
+		}
+		fetch := &blockFetch{index: i, done: make(chan struct{})}
+		f.inflight[i] = fetch
+		owned = append(owned, fetch)
+	}
+	f.mu.Unlock()
+
+	f.fetchBlocks(owned)
+	for _, fetch := range append(owned, waiting...) {
+		select {
+		case <-fetch.done:
+		case <-f.ctx.Done():
+			return nil, f.ctx.Err()
+		}
+		if fetch.err != nil {
+			return nil, fetch.err
+		}
+		blocks[fetch.index-first] = fetch.data
+	}
+	return blocks, nil
+}
+
+// readAheadFrom starts fetching the blocks after last in the background if the read from off to end continues on from
+// the previous read.
+func (f *RemoteFile) readAheadFrom(off, end, last int64) {
+	f.mu.Lock()
+	if off == f.lastEnd && f.g.maxReadAhead > 0 {
+		f.readAhead = min(max(f.readAhead*2, 1), f.g.maxReadAhead)
+	} else {
+		f.readAhead = 0
+	}
+	f.lastEnd = end
+
+	var owned []*blockFetch
+	lastBlock := (f.size - 1) / f.blockSize
+	for i := last + 1; i <= min(last+int64(f.readAhead), lastBlock); i++ {
+		if f.cache.Contains(i) || f.inflight[i] != nil {
+			continue
+		}
+		fetch := &blockFetch{index: i, done: make(chan struct{})}
+		f.inflight[i] = fetch
+		owned = append(owned, fetch)
+	}
+	f.mu.Unlock()
+
+	if len(owned) > 0 {
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			f.fetchBlocks(owned)
+		}()
+	}
+}
+
+// fetchBlocks fetches blocks, which must already be marked as in flight, in parallel. Runs of adjacent blocks are
+// coalesced into a single request.
+func (f *RemoteFile) fetchBlocks(fetches []*blockFetch) {
+	wg := sync.WaitGroup{}
+	for start := 0; start < len(fetches); {
+		end := start + 1
+		for end < len(fetches) && end-start < maxCoalescedBlocks && fetches[end].index == fetches[end-1].index+1 {
+			end++
+		}
+		run := fetches[start:end]
+		start = end
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.fetchRun(run)
+		}()
+	}
+	wg.Wait()
+}
+
+// fetchRun fetches a run of adjacent blocks with a single ranged request.
+func (f *RemoteFile) fetchRun(run []*blockFetch) {
+	startPos := run[0].index * f.blockSize
+	endPos := min((run[len(run)-1].index+1)*f.blockSize, f.size)
+	buffer := &bytes.Buffer{}
+
+	err := f.semaphore.AcquireContext(f.ctx)
+	if err == nil {
+		fragment := newHttpFragment(f.g.srcUrl, byteRange{first: startPos, last: endPos - 1})
+		err = f.g.fetchFragment(f.ctx, fragment, buffer, f.d)
+		f.semaphore.Release()
+	}
+
+	data := buffer.Bytes()
+	f.mu.Lock()
+	for i, fetch := range run {
+		if err != nil {
+			fetch.err = err
+		} else {
+			fetch.data = data[int64(i)*f.blockSize : min(int64(i+1)*f.blockSize, int64(len(data)))]
+			f.cache.Add(fetch.index, fetch.data)
+		}
+		delete(f.inflight, fetch.index)
+	}
+	f.mu.Unlock()
+
+	for _, fetch := range run {
+		close(fetch.done)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func openRemoteFile(t *testing.T, payload []byte, ranged *atomic.Int32, options ...Option) *RemoteFile {
+	server := newTestServer(payload, serverConfig{etag: `"v1"`, ranged: ranged})
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	f, err := NewGranger(u, options...).Open(context.Background())
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = f.Close() })
+	return f
+}
+
+func TestBlockCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newBlockCache(2)
+	c.Add(0, []byte("a"))
+	c.Add(1, []byte("b"))
+	_, ok := c.Get(0)
+	assert.True(t, ok)
+
+	c.Add(2, []byte("c"))
+	assert.Equal(t, 2, c.Len())
+	assert.True(t, c.Contains(0))
+	assert.False(t, c.Contains(1))
+	assert.True(t, c.Contains(2))
+}
+
+func TestRemoteFileReadAt(t *testing.T) {
+	payload := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(payload)
+	f := openRemoteFile(t, payload, &atomic.Int32{}, WithBlockSize(64), WithParallelization(4))
+	assert.Equal(t, int64(len(payload)), f.Size())
+
+	random := rand.New(rand.NewSource(2))
+	for i := 0; i < 100; i++ {
+		off := random.Intn(len(payload))
+		p := make([]byte, random.Intn(200)+1)
+		n, err := f.ReadAt(p, int64(off))
+		want := payload[off:min(off+len(p), len(payload))]
+		assert.Equal(t, len(want), n)
+		assert.Equal(t, want, p[:n])
+		if n < len(p) {
+			assert.Equal(t, io.EOF, err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+
+	_, err := f.ReadAt(make([]byte, 1), int64(len(payload)))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestRemoteFileZeroBlockSize(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	ranged := &atomic.Int32{}
+	// A block size of 0 falls back to the default, rather than dividing by zero.
+	f := openRemoteFile(t, payload, ranged, WithBlockSize(0))
+	buffer := make([]byte, 5)
+	n, err := f.ReadAt(buffer, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(buffer[:n]))
+	assert.Equal(t, int64(defaultBlockSize), f.blockSize)
+}
+
+func TestRemoteFileCoalescesAndCaches(t *testing.T) {
+	payload := bytes.Repeat([]byte("granger!"), 32)
+	ranged := &atomic.Int32{}
+	f := openRemoteFile(t, payload, ranged, WithBlockSize(16), WithReadAhead(0))
+
+	// Four adjacent blocks which aren't cached are fetched together, after the probe for range support.
+	p := make([]byte, 64)
+	_, err := f.ReadAt(p, 32)
+	assert.NoError(t, err)
+	assert.Equal(t, payload[32:96], p)
+	assert.Equal(t, int32(2), ranged.Load())
+
+	// Reading them again is served from the cache.
+	_, err = f.ReadAt(p[:10], 40)
+	assert.NoError(t, err)
+	assert.Equal(t, payload[40:50], p[:10])
+	assert.Equal(t, int32(2), ranged.Load())
+}
+
+func TestRemoteFileReadsAhead(t *testing.T) {
+	payload := make([]byte, 1024)
+	rand.New(rand.NewSource(3)).Read(payload)
+
+	read := func(options ...Option) int32 {
+		ranged := &atomic.Int32{}
+		f := openRemoteFile(t, payload, ranged, append(options, WithBlockSize(16))...)
+		data := make([]byte, len(payload))
+		for off := 0; off < len(data); off += 16 {
+			_, err := io.ReadFull(f, data[off:off+16])
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, payload, data)
+		return ranged.Load()
+	}
+
+	// Without read ahead every small read misses the cache.
+	withoutReadAhead := read(WithReadAhead(0))
+	withReadAhead := read(WithReadAhead(8))
+	assert.Less(t, withReadAhead, withoutReadAhead)
+}
+
+func TestRemoteFileSeek(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	f := openRemoteFile(t, payload, &atomic.Int32{}, WithBlockSize(4))
+
+	pos, err := f.Seek(-8, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(16), pos)
+	data, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, payload[16:], data)
+
+	pos, err = f.Seek(6, io.SeekStart)
+	assert.NoError(t, err)
+	pos, err = f.Seek(-1, io.SeekCurrent)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), pos)
+
+	_, err = f.Seek(-10, io.SeekStart)
+	assert.ErrorIs(t, err, ErrInvalidSeek)
+}
+
+func TestRemoteFileOpensZip(t *testing.T) {
+	archive := &bytes.Buffer{}
+	zw := zip.NewWriter(archive)
+	contents := map[string][]byte{
+		"a.txt": []byte("hello world"),
+		"b.txt": bytes.Repeat([]byte("granger "), 500),
+	}
+	for name, data := range contents {
+		w, err := zw.Create(name)
+		assert.NoError(t, err)
+		_, err = w.Write(data)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, zw.Close())
+
+	ranged := &atomic.Int32{}
+	f := openRemoteFile(t, archive.Bytes(), ranged, WithBlockSize(256), WithParallelization(2))
+	zr, err := zip.NewReader(f, f.Size())
+	assert.NoError(t, err)
+	assert.Len(t, zr.File, 2)
+
+	for _, file := range zr.File {
+		rc, err := file.Open()
+		assert.NoError(t, err)
+		data, err := io.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		assert.Equal(t, contents[file.Name], data)
+	}
+	assert.Greater(t, ranged.Load(), int32(0))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMaxAttempts = 1
+	maxBackoff         = 30 * time.Second
+)
+
+// RetryPolicy describes how many times a fragment is attempted before giving up, and how long to wait in between.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// Backoff is the delay before the first retry. It doubles with each subsequent retry.
+	Backoff time.Duration
+	// Jitter is the fraction, between 0 and 1, of each delay which is randomized.
+	Jitter float64
+}
+
+// StatusError is returned when the server responds with a non-2xx status code.
+type StatusError struct {
+	StatusCode int
+	// RetryAfter is how long the server asked us to wait before trying again, if it said.
+	RetryAfter time.Duration
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("received non-200 code: %v", e.StatusCode)
+}
+
+// FragmentError is returned by WriteTo when a fragment could not be fetched within the retry policy.
+type FragmentError struct {
+	StartPos int
+	EndPos   int
+	Attempts int
+	Err      error
+}
+
+func (e *FragmentError) Error() string {
+	return fmt.Sprintf("fragment %v to %v failed after %v attempts: %v", e.StartPos, e.EndPos, e.Attempts, e.Err)
+}
+
+func (e *FragmentError) Unwrap() error {
+	return e.Err
+}
+
+// Do calls fn until it succeeds, it returns an error which isn't worth retrying, we run out of attempts, or ctx is
+// done. It returns the number of attempts made along with the last error.
+func (p RetryPolicy) Do(ctx context.Context, fn func() error) (int, error) {
+	return p.do(ctx, fn, nil)
+}
+
+// do is like Do, but calls onRetry, if it isn't nil, with each failed attempt that is going to be retried.
+func (p RetryPolicy) do(ctx context.Context, fn func() error,
+	onRetry func(attempt int, delay time.Duration, err error)) (int, error) {
+	attempt := 1
+	for ; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !isRetryable(err) || ctx.Err() != nil {
+			return attempt, err
+		}
+
+		delay := p.delay(attempt, err)
+		if onRetry != nil {
+			onRetry(attempt, delay, err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, err
+		}
+	}
+}
+
+// delay returns how long to wait after the given attempt failed with err. A Retry-After from the server is honoured,
+// but never beyond maxBackoff, so that a server can't stall a fragment for hours.
+func (p RetryPolicy) delay(attempt int, err error) time.Duration {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		return min(statusErr.RetryAfter, maxBackoff)
+	}
+
+	d := p.Backoff
+	for i := 1; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, maxBackoff)
+	if p.Jitter > 0 {
+		d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+	}
+
+	return d
+}
+
+// failoverError is an error from one mirror which is worth retrying on another, even if it isn't worth retrying on the
+// same one.
+type failoverError struct {
+	err error
+}
+
+func (e *failoverError) Error() string {
+	return e.err.Error()
+}
+
+func (e *failoverError) Unwrap() error {
+	return e.err
+}
+
+// isRetryable returns false for client errors which will fail the same way every time.
+func isRetryable(err error) bool {
+	var failoverErr *failoverError
+	if errors.As(err, &failoverErr) {
+		return true
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		// Connection resets, timeouts, and truncated bodies are all worth another try.
+		return true
+	}
+	switch statusErr.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return statusErr.StatusCode >= 500
+}
+
+// parseRetryAfter supports both forms of the Retry-After header: a number of seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newFlakyServer serves payload, but fails the first `failures` requests for each fragment with the given handler.
+// The probe for range support always succeeds.
+func newFlakyServer(payload []byte, failures int, fail http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(newFlakyHandler(payload, failures, fail))
+}
+
+// newFlakyHandler is the handler behind newFlakyServer, for serving without a network.
+func newFlakyHandler(payload []byte, failures int, fail http.HandlerFunc) http.Handler {
+	mu := sync.Mutex{}
+	attempts := map[string]int{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rng := r.Header.Get("Range")
+		mu.Lock()
+		attempts[rng] += 1
+		attempt := attempts[rng]
+		mu.Unlock()
+
+		if rng != "" && rng != "bytes=0-0" && attempt <= failures {
+			fail(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	})
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	tests := map[string]http.HandlerFunc{
+		"service unavailable": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+		"too many requests": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTooManyRequests)
+		},
+		"truncated body": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "8")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write([]byte("hel"))
+		},
+	}
+
+	for name, fail := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := newFlakyServer(payload, 2, fail)
+			defer server.Close()
+
+			u, err := url.Parse(server.URL)
+			assert.NoError(t, err)
+
+			g := NewGranger(u, WithFragmentSize(8), WithParallelization(2), WithRetryPolicy(3, time.Millisecond, 0.5))
+			buffer := &bytes.Buffer{}
+			_, err = g.WriteTo(buffer)
+			assert.NoError(t, err)
+			assert.Equal(t, payload, buffer.Bytes())
+		})
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := newFlakyServer(payload, 10, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	g := NewGranger(u, WithFragmentSize(8), WithRetryPolicy(3, time.Millisecond, 0))
+	_, err = g.WriteTo(&bytes.Buffer{})
+
+	var fragmentErr *FragmentError
+	assert.True(t, errors.As(err, &fragmentErr))
+	assert.Equal(t, 3, fragmentErr.Attempts)
+	var statusErr *StatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusInternalServerError, statusErr.StatusCode)
+}
+
+func TestRetrySkipsClientErrors(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := newFlakyServer(payload, 10, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	g := NewGranger(u, WithFragmentSize(8), WithRetryPolicy(3, time.Millisecond, 0))
+	_, err = g.WriteTo(&bytes.Buffer{})
+
+	var fragmentErr *FragmentError
+	assert.True(t, errors.As(err, &fragmentErr))
+	assert.Equal(t, 1, fragmentErr.Attempts)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 3*time.Second, parseRetryAfter("3"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)))
+	assert.InDelta(t, time.Hour, parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)), float64(2*time.Second))
+}
+
+func TestRetryAfterIsCapped(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+	assert.Equal(t, 3*time.Second, p.delay(1, &StatusError{StatusCode: 503, RetryAfter: 3 * time.Second}))
+	assert.Equal(t, maxBackoff, p.delay(1, &StatusError{StatusCode: 503, RetryAfter: 24 * time.Hour}))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// S3Client is the part of *s3.Client used by S3Source.
+type S3Client interface {
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput,
+		error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput,
+		error)
+}
+
+// S3Source fetches an object from S3 with the S3 API rather than plain HTTP. If the object was uploaded in parts,
+// each part is fetched whole with GetObject's PartNumber and checked against its checksum, if S3 has one.
+type S3Source struct {
+	client S3Client
+	bucket string
+	key    string
+
+	mu    sync.Mutex
+	etag  string
+	parts []int64
+}
+
+// NewS3Source returns a source for key in bucket, for use with WithSource.
+func NewS3Source(client S3Client, bucket, key string) *S3Source {
+	return &S3Source{
+		client: client,
+		bucket: bucket,
+		key:    key,
+	}
+}
+
+func (s *S3Source) String() string {
+	return fmt.Sprintf("s3://%v/%v", s.bucket, s.key)
+}
+
+func (s *S3Source) Stat(ctx context.Context) (*ObjectInfo, error) {
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(s.key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return nil, err
+	}
+	info := &ObjectInfo{
+		Size: -1,
+		ETag: aws.ToString(head.ETag),
+		Digests: advertisedDigests(s3ChecksumHeader(head.ChecksumSHA256, head.ChecksumCRC32C, head.ChecksumCRC32,
+			head.ChecksumSHA1)),
+	}
+	if head.ContentLength != nil {
+		info.Size = *head.ContentLength
+	}
+	if head.LastModified != nil {
+		info.LastModified = head.LastModified.UTC().Format(http.TimeFormat)
+	}
+	if info.Size > 0 {
+		if info.Parts, err = s.partSizes(ctx, info.ETag, info.Size); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	s.etag, s.parts = info.ETag, info.Parts
+	s.mu.Unlock()
+	return info, nil
+}
+
+// partSizes returns the size of each part of a multipart object, or nil if it wasn't uploaded in parts. Uploads
+// almost always use the same size for every part but the last, so we only ask about the first and last parts unless
+// they tell us otherwise.
+func (s *S3Source) partSizes(ctx context.Context, etag string, size int64) ([]int64, error) {
+	first, err := s.headPart(ctx, etag, 1)
+	if err != nil {
+		return nil, err
+	}
+	count := int(aws.ToInt32(first.PartsCount))
+	if count < 2 {
+		return nil, nil
+	}
+
+	partSize := aws.ToInt64(first.ContentLength)
+	lastSize := size - partSize*int64(count-1)
+	if lastSize > 0 && lastSize <= partSize {
+		last, err := s.headPart(ctx, etag, count)
+		if err != nil {
+			return nil, err
+		}
+		if aws.ToInt64(last.ContentLength) == lastSize {
+			parts := make([]int64, count)
+			for i := range parts {
+				parts[i] = partSize
+			}
+			parts[count-1] = lastSize
+			return parts, nil
+		}
+	}
+
+	parts := make([]int64, count)
+	parts[0] = partSize
+	for i := 1; i < count; i++ {
+		part, err := s.headPart(ctx, etag, i+1)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = aws.ToInt64(part.ContentLength)
+	}
+	return parts, nil
+}
+
+func (s *S3Source) headPart(ctx context.Context, etag string, part int) (*s3.HeadObjectOutput, error) {
+	input := &s3.HeadObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(s.key),
+		PartNumber: aws.Int32(int32(part)),
+	}
+	if etag != "" {
+		input.IfMatch = aws.String(etag)
+	}
+	return s.client.HeadObject(ctx, input)
+}
+
+func (s *S3Source) Fetch(ctx context.Context, first, last int64, w io.Writer) error {
+	s.mu.Lock()
+	etag, parts := s.etag, s.parts
+	s.mu.Unlock()
+
+	rng := byteRange{first: first, last: last}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	}
+	// Make sure every fragment comes from the version of the object we were asked to fetch.
+	if etag != "" {
+		input.IfMatch = aws.String(etag)
+	}
+	part := partNumber(parts, rng)
+	if part > 0 {
+		input.PartNumber = aws.Int32(int32(part))
+		input.ChecksumMode = types.ChecksumModeEnabled
+	} else {
+		input.Range = aws.String(rng.String())
+	}
+	out, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+
+	contentRange := aws.ToString(out.ContentRange)
+	if got, gotLast, _, err := parseContentRange(contentRange); err != nil || got != first || gotLast != last {
+		return &RangeError{Requested: rng.String(), StatusCode: http.StatusPartialContent, ContentRange: contentRange}
+	}
+
+	var digests []Digest
+	if part > 0 {
+		digests = advertisedDigests(s3ChecksumHeader(out.ChecksumSHA256, out.ChecksumCRC32C, out.ChecksumCRC32,
+			out.ChecksumSHA1))
+		for i := range digests {
+			digests[i].Source = fmt.Sprintf("%v of part %v", digests[i].Source, part)
+		}
+	}
+	v, err := newVerifier(digests)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(io.MultiWriter(w, v), out.Body, rng.size()); err != nil {
+		return err
+	}
+	return v.Verify()
+}
+
+// partNumber returns the number of the part which rng covers exactly, or zero if it isn't a whole part.
+func partNumber(parts []int64, rng byteRange) int {
+	start := int64(0)
+	for i, size := range parts {
+		if start == rng.first {
+			if size == rng.size() {
+				return i + 1
+			}
+			return 0
+		}
+		start += size
+	}
+	return 0
+}
+
+// s3ChecksumHeader puts the checksums S3 returned back into the headers they were sent in, so that they can be parsed
+// like any other advertised digest.
+func s3ChecksumHeader(sha256, crc32c, crc32, sha1 *string) http.Header {
+	header := http.Header{}
+	for name, value := range map[string]*string{
+		"x-amz-checksum-sha256": sha256,
+		"x-amz-checksum-crc32c": crc32c,
+		"x-amz-checksum-crc32":  crc32,
+		"x-amz-checksum-sha1":   sha1,
+	} {
+		if value != nil {
+			header.Set(name, *value)
+		}
+	}
+	return header
+}
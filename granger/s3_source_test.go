@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// s3Stub is a minimal S3-compatible server holding a single object at /bucket/key, which supports HeadObject and
+// GetObject by range or part number.
+type s3Stub struct {
+	payload []byte
+	// parts are the sizes of the parts the object was uploaded in, or nil if it was uploaded in one go.
+	parts []int64
+	// corruptPart is the number of a part whose bytes are sent corrupted, or zero.
+	corruptPart int
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func newS3Stub(t *testing.T, stub *s3Stub) *s3.Client {
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	return s3.New(s3.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(server.URL),
+		UsePathStyle:     true,
+		Credentials:      aws.AnonymousCredentials{},
+		RetryMaxAttempts: 1,
+	})
+}
+
+func (s *s3Stub) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func sha256Base64(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (s *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const etag = `"0123456789abcdef"`
+	if r.URL.Path != "/bucket/key" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" && match != etag {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat))
+	checksums := r.Header.Get("X-Amz-Checksum-Mode") == "ENABLED"
+
+	first, last := int64(0), int64(len(s.payload)-1)
+	request := r.Method
+	status := http.StatusOK
+	if part := r.URL.Query().Get("partNumber"); part != "" {
+		request = fmt.Sprintf("%v part=%v", r.Method, part)
+		n, _ := strconv.Atoi(part)
+		if s.parts != nil {
+			if n < 1 || n > len(s.parts) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			for _, size := range s.parts[:n-1] {
+				first += size
+			}
+			last = first + s.parts[n-1] - 1
+			w.Header().Set("X-Amz-Mp-Parts-Count", strconv.Itoa(len(s.parts)))
+		}
+		status = http.StatusPartialContent
+		if checksums {
+			w.Header().Set("X-Amz-Checksum-Sha256", sha256Base64(s.payload[first:last+1]))
+		}
+	} else if rng := r.Header.Get("Range"); rng != "" {
+		request = fmt.Sprintf("%v %v", r.Method, rng)
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &first, &last); err != nil || last >= int64(len(s.payload)) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		status = http.StatusPartialContent
+	} else if checksums {
+		// The checksum of a multipart upload is a checksum of the part checksums.
+		checksum := sha256Base64(s.payload)
+		if s.parts != nil {
+			checksum += fmt.Sprintf("-%v", len(s.parts))
+		}
+		w.Header().Set("X-Amz-Checksum-Sha256", checksum)
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, request)
+	s.mu.Unlock()
+
+	body := append([]byte{}, s.payload[first:last+1]...)
+	if part, _ := strconv.Atoi(r.URL.Query().Get("partNumber")); part != 0 && part == s.corruptPart {
+		body[0] ^= 0xff
+	}
+	if status == http.StatusPartialContent {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", first, last, len(s.payload)))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(body)
+	}
+}
+
+func randomPayload(size int) []byte {
+	payload := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(payload)
+	return payload
+}
+
+func TestS3SourceFetchesParts(t *testing.T) {
+	stub := &s3Stub{payload: randomPayload(50), parts: []int64{16, 16, 16, 2}}
+	client := newS3Stub(t, stub)
+
+	g := NewGranger(nil, WithSource(NewS3Source(client, "bucket", "key")), WithParallelization(3),
+		WithFragmentSize(5), WithChecksumVerification())
+	buffer := &bytes.Buffer{}
+	n, err := g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(50), n)
+	assert.Equal(t, stub.payload, buffer.Bytes())
+
+	// The parts are fetched whole, whatever the fragment size, and the part sizes are worked out from the first and
+	// last parts.
+	assert.ElementsMatch(t, []string{"HEAD", "HEAD part=1", "HEAD part=4",
+		"GET part=1", "GET part=2", "GET part=3", "GET part=4"}, stub.Requests())
+
+	reader, err := g.Reader(context.Background())
+	assert.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, stub.payload, data)
+	assert.NoError(t, reader.Close())
+}
+
+func TestS3SourceUnevenParts(t *testing.T) {
+	stub := &s3Stub{payload: randomPayload(35), parts: []int64{10, 20, 5}}
+	client := newS3Stub(t, stub)
+
+	w := &recordingWriterAt{}
+	g := NewGranger(nil, WithSource(NewS3Source(client, "bucket", "key")), WithParallelization(2))
+	_, err := g.WriteToAt(w)
+	assert.NoError(t, err)
+	assert.Equal(t, stub.payload, w.data)
+	assert.ElementsMatch(t, []string{"HEAD", "HEAD part=1", "HEAD part=2", "HEAD part=3",
+		"GET part=1", "GET part=2", "GET part=3"}, stub.Requests())
+}
+
+func TestS3SourceFetchesRanges(t *testing.T) {
+	stub := &s3Stub{payload: randomPayload(20)}
+	client := newS3Stub(t, stub)
+
+	g := NewGranger(nil, WithSource(NewS3Source(client, "bucket", "key")), WithFragmentSize(8),
+		WithChecksumVerification())
+	buffer := &bytes.Buffer{}
+	_, err := g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, stub.payload, buffer.Bytes())
+	assert.Equal(t, []string{"HEAD", "HEAD part=1", "GET bytes=0-7", "GET bytes=8-15", "GET bytes=16-19"},
+		stub.Requests())
+
+	f, err := NewGranger(nil, WithSource(NewS3Source(client, "bucket", "key")), WithBlockSize(4)).
+		Open(context.Background())
+	assert.NoError(t, err)
+	p := make([]byte, 6)
+	_, err = f.ReadAt(p, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, stub.payload[5:11], p)
+	assert.NoError(t, f.Close())
+}
+
+func TestS3SourceCorruptPart(t *testing.T) {
+	stub := &s3Stub{payload: randomPayload(40), parts: []int64{16, 16, 8}, corruptPart: 2}
+	client := newS3Stub(t, stub)
+
+	g := NewGranger(nil, WithSource(NewS3Source(client, "bucket", "key")), WithRetryPolicy(1, 0, 0))
+	_, err := g.WriteTo(&bytes.Buffer{})
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestS3SourceMissingObject(t *testing.T) {
+	client := newS3Stub(t, &s3Stub{payload: randomPayload(8)})
+
+	g := NewGranger(nil, WithSource(NewS3Source(client, "bucket", "missing")), WithRetryPolicy(1, 0, 0))
+	_, err := g.WriteTo(&bytes.Buffer{})
+	assert.Error(t, err)
+}
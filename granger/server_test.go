@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+)
+
+// serverConfig describes how newTestServer serves its payload.
+type serverConfig struct {
+	// etag and headers are set on every response.
+	etag    string
+	headers map[string]string
+	// ranged, if set, counts the ranged requests received.
+	ranged *atomic.Int32
+	// failStatus, if set, is the status every ranged request fails with.
+	failStatus int
+}
+
+// newTestServer serves payload as a well-behaved origin would, with support for range requests.
+func newTestServer(payload []byte, config serverConfig) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			if config.ranged != nil {
+				config.ranged.Add(1)
+			}
+			if config.failStatus != 0 {
+				w.WriteHeader(config.failStatus)
+				return
+			}
+		}
+		if config.etag != "" {
+			w.Header().Set("ETag", config.etag)
+		}
+		for k, v := range config.headers {
+			w.Header().Set(k, v)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	}))
+}
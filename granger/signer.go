@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// emptyPayloadHash is the SHA-256 of an empty body, which is what every request we send has.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// defaultTokenExpiryMargin is how long before a bearer token expires that we refresh it, so that it doesn't
+	// expire while a request is in flight.
+	defaultTokenExpiryMargin = 30 * time.Second
+)
+
+var (
+	// ErrNoToken is returned by BearerTokenSigner when its TokenSource returns an empty token.
+	ErrNoToken = errors.New("granger: token source returned an empty token")
+)
+
+// RequestSigner authenticates every request sent for the source, e.g. by adding an Authorization header. Requests
+// are signed after the Range and any custom headers have been added, and again on every retry.
+type RequestSigner interface {
+	Sign(req *http.Request) error
+}
+
+// invalidator is implemented by signers whose credentials can be refreshed after the server rejects them.
+type invalidator interface {
+	Invalidate()
+}
+
+// WithRequestSigner signs every request sent for the source with signer.
+func WithRequestSigner(signer RequestSigner) Option {
+	return func(g *Granger) {
+		g.signer = signer
+	}
+}
+
+// SigV4Signer signs requests with AWS Signature Version 4, e.g. to fetch from a private S3 bucket.
+type SigV4Signer struct {
+	credentials aws.CredentialsProvider
+	region      string
+	service     string
+	signer      *v4.Signer
+	now         func() time.Time
+}
+
+// NewSigV4Signer returns a signer for service in region, e.g. "s3" and "us-east-1". The credentials are retrieved
+// for every request, so should be cached, e.g. with aws.NewCredentialsCache.
+func NewSigV4Signer(credentials aws.CredentialsProvider, region, service string) *SigV4Signer {
+	return &SigV4Signer{
+		credentials: credentials,
+		region:      region,
+		service:     service,
+		signer:      v4.NewSigner(),
+		now:         time.Now,
+	}
+}
+
+func (s *SigV4Signer) Sign(req *http.Request) error {
+	credentials, err := s.credentials.Retrieve(req.Context())
+	if err != nil {
+		return err
+	}
+	// S3 refuses requests which don't say what the payload hash is.
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	// A retry reuses the request, so drop the signature from the previous attempt.
+	req.Header.Del("Authorization")
+	req.Header.Del("X-Amz-Date")
+	req.Header.Del("X-Amz-Security-Token")
+	return s.signer.SignHTTP(req.Context(), credentials, req, emptyPayloadHash, s.service, s.region, s.now())
+}
+
+// TokenSource returns a bearer token and when it expires. A zero expiry means the token doesn't expire.
+type TokenSource func(ctx context.Context) (token string, expiry time.Time, err error)
+
+// BearerTokenSigner adds an "Authorization: Bearer" header to every request. The token is fetched from its
+// TokenSource when first needed, and again shortly before it expires or once the server rejects it.
+type BearerTokenSigner struct {
+	source TokenSource
+	now    func() time.Time
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func NewBearerTokenSigner(source TokenSource) *BearerTokenSigner {
+	return &BearerTokenSigner{
+		source: source,
+		now:    time.Now,
+	}
+}
+
+func (s *BearerTokenSigner) Sign(req *http.Request) error {
+	token, err := s.Token(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Token returns the current token, refreshing it first if it has expired or is about to.
+func (s *BearerTokenSigner) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && (s.expiry.IsZero() || s.now().Add(defaultTokenExpiryMargin).Before(s.expiry)) {
+		return s.token, nil
+	}
+	token, expiry, err := s.source(ctx)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		return "", ErrNoToken
+	}
+	s.token, s.expiry = token, expiry
+	return token, nil
+}
+
+// Invalidate discards the current token, so that the next request fetches a new one.
+func (s *BearerTokenSigner) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = ""
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newAuthServer serves payload, but only to requests which authorize is happy with.
+func newAuthServer(payload []byte, authorize func(r *http.Request) bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	}))
+}
+
+func TestRequestHeaders(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := newAuthServer(payload, func(r *http.Request) bool {
+		return r.Header.Get("X-Api-Key") == "secret" && r.Host == "granger.internal"
+	})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	g := NewGranger(u, WithFragmentSize(8), WithParallelization(2), WithRequestHeaders(http.Header{
+		"x-api-key": {"secret"},
+		"Host":      {"granger.internal"},
+		// The Range of each fragment must win over this.
+		"Range": {"bytes=0-1"},
+	}))
+	buffer := &bytes.Buffer{}
+	_, err = g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, buffer.Bytes())
+}
+
+func TestRequestHeadersAreNotSentToMirrors(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	primary := newAuthServer(payload, func(r *http.Request) bool {
+		return r.Header.Get("X-Api-Key") == "secret" && r.Header.Get("Authorization") == "Bearer token" &&
+			r.Host == "granger.internal"
+	})
+	defer primary.Close()
+	served, leaked := &atomic.Int32{}, &atomic.Int32{}
+	mirror := newAuthServer(payload, func(r *http.Request) bool {
+		if r.Header.Get("X-Api-Key") != "" || r.Header.Get("Authorization") != "" || r.Host == "granger.internal" {
+			leaked.Add(1)
+		}
+		if r.Header.Get("Range") != "" {
+			served.Add(1)
+		}
+		return true
+	})
+	defer mirror.Close()
+
+	primaryUrl, _ := url.Parse(primary.URL)
+	mirrorUrl, _ := url.Parse(mirror.URL)
+	signer := NewBearerTokenSigner(func(ctx context.Context) (string, time.Time, error) {
+		return "token", time.Now().Add(time.Hour), nil
+	})
+	g := NewGranger(primaryUrl, WithFragmentSize(2), WithParallelization(2), WithMirrors(mirrorUrl),
+		WithRequestSigner(signer), WithRequestHeaders(http.Header{
+			"x-api-key": {"secret"},
+			"Host":      {"granger.internal"},
+		}))
+	buffer := &bytes.Buffer{}
+	_, err := g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, buffer.Bytes())
+	// The mirror served some fragments without ever seeing the credentials.
+	assert.Greater(t, served.Load(), int32(0))
+	assert.Equal(t, int32(0), leaked.Load())
+}
+
+// countingTransport counts the requests sent through it.
+type countingTransport struct {
+	requests atomic.Int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := newTestServer(payload, serverConfig{})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	transport := &countingTransport{}
+	g := NewGranger(u, WithFragmentSize(8), WithHTTPClient(&http.Client{Transport: transport}))
+	_, err = g.WriteTo(&bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(4), transport.requests.Load())
+
+	// The default client is left alone.
+	https, err := url.Parse("https://example.com/object")
+	assert.NoError(t, err)
+	NewGranger(https)
+	assert.Nil(t, http.DefaultClient.Transport)
+}
+
+func TestBearerTokenSigner(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	current := &atomic.Value{}
+	current.Store("token-1")
+	server := newAuthServer(payload, func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer "+current.Load().(string)
+	})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	issued := &atomic.Int32{}
+	signer := NewBearerTokenSigner(func(ctx context.Context) (string, time.Time, error) {
+		issued.Add(1)
+		return current.Load().(string), now.Add(time.Hour), nil
+	})
+	signer.now = func() time.Time { return now }
+
+	g := NewGranger(u, WithFragmentSize(8), WithParallelization(2), WithRequestSigner(signer))
+	buffer := &bytes.Buffer{}
+	_, err = g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, buffer.Bytes())
+	assert.Equal(t, int32(1), issued.Load())
+
+	// Once the token is about to expire, a new one is fetched.
+	now = now.Add(time.Hour - time.Second)
+	buffer.Reset()
+	_, err = g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), issued.Load())
+
+	// If the server revokes the token, a new one is fetched and the request sent again.
+	current.Store("token-2")
+	buffer.Reset()
+	_, err = g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, buffer.Bytes())
+	assert.Equal(t, int32(3), issued.Load())
+}
+
+func TestBearerTokenSignerEmptyToken(t *testing.T) {
+	signer := NewBearerTokenSigner(func(ctx context.Context) (string, time.Time, error) {
+		return "", time.Time{}, nil
+	})
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.ErrorIs(t, signer.Sign(req), ErrNoToken)
+}
+
+func TestSigV4Signer(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	credentials := aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET", SessionToken: "TOKEN"}, nil
+	})
+	signingTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	signed := &atomic.Int32{}
+
+	server := newAuthServer(payload, func(r *http.Request) bool {
+		authorization := r.Header.Get("Authorization")
+		_, signedHeaders, ok := strings.Cut(authorization, "SignedHeaders=")
+		if !ok {
+			return false
+		}
+		signedHeaders, _, _ = strings.Cut(signedHeaders, ",")
+
+		// Sign what we received again, and make sure we get the same signature.
+		req, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+		assert.NoError(t, err)
+		for _, header := range strings.Split(signedHeaders, ";") {
+			if header != "host" {
+				req.Header.Set(header, r.Header.Get(header))
+			}
+		}
+		verifier := NewSigV4Signer(credentials, "us-east-1", "s3")
+		verifier.now = func() time.Time { return signingTime }
+		assert.NoError(t, verifier.Sign(req))
+
+		signed.Add(1)
+		return strings.Contains(signedHeaders, "range") == (r.Header.Get("Range") != "") &&
+			strings.HasPrefix(authorization,
+				fmt.Sprintf("AWS4-HMAC-SHA256 Credential=AKID/%v/us-east-1/s3/aws4_request", signingTime.Format("20060102"))) &&
+			req.Header.Get("Authorization") == authorization &&
+			r.Header.Get("X-Amz-Security-Token") == "TOKEN"
+	})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	signer := NewSigV4Signer(credentials, "us-east-1", "s3")
+	signer.now = func() time.Time { return signingTime }
+	g := NewGranger(u, WithFragmentSize(8), WithParallelization(2), WithRequestSigner(signer),
+		WithRetryPolicy(2, time.Millisecond, 0))
+	buffer := &bytes.Buffer{}
+	_, err = g.WriteTo(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, buffer.Bytes())
+	assert.Equal(t, int32(4), signed.Load())
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	// ErrUnknownSize is returned when a Source other than HTTP doesn't know the size of the object.
+	ErrUnknownSize = errors.New("granger: source did not report the size of the object")
+)
+
+// Source is where an object is downloaded from. Unless WithSource is given, Granger fetches the object over HTTP
+// from the URL it was created with.
+type Source interface {
+	// Stat returns the size of the object, along with anything else known about it before it is fetched.
+	Stat(ctx context.Context) (*ObjectInfo, error)
+	// Fetch writes the bytes of the object from first to last, inclusive, to w. It is called concurrently, and is
+	// called again for the same bytes if it fails and the retry policy allows it.
+	Fetch(ctx context.Context, first, last int64, w io.Writer) error
+}
+
+// ObjectInfo describes an object before it is fetched.
+type ObjectInfo struct {
+	// Size is the size of the object, or -1 if it is unknown.
+	Size int64
+	// ETag and LastModified identify the version of the object, so that a download is never resumed from, or
+	// mixed with, bytes of a different version. Either may be empty.
+	ETag         string
+	LastModified string
+	// Digests are checksums of the whole object, which are checked when checksum verification is enabled.
+	Digests []Digest
+	// Parts are the sizes of the parts the object is stored in. If there are any, fragments follow the boundaries
+	// of the parts rather than the fragment size, so that the source can fetch whole parts.
+	Parts []int64
+}
+
+// WithSource downloads the object from source rather than the URL given to NewGranger, which may then be nil.
+// Mirrors, and the fallback for servers which don't support ranges, are only available for HTTP.
+func WithSource(source Source) Option {
+	return func(g *Granger) {
+		g.source = source
+	}
+}
+
+// httpSource fetches the object with ranged GETs from a URL. It is the source used unless WithSource is given, and
+// serves any mirrors.
+type httpSource struct {
+	g   *Granger
+	url *url.URL
+	// mirror is true for a mirror rather than the source itself. Mirrors may be run by someone else, such as a CDN,
+	// so their requests are neither given the request headers nor signed.
+	mirror bool
+}
+
+// do sends req to the source.
+func (s *httpSource) do(req *http.Request) (*http.Response, error) {
+	if s.mirror {
+		return s.g.httpClient.Do(req)
+	}
+	return s.g.do(req)
+}
+
+func (s *httpSource) Stat(ctx context.Context) (*ObjectInfo, error) {
+	info, err := s.g.probeRequest(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if !info.rangeable {
+		if info.resp != nil {
+			_ = info.resp.Body.Close()
+		}
+		return nil, ErrRangeNotSupported
+	}
+	return &info.ObjectInfo, nil
+}
+
+func (s *httpSource) String() string {
+	return s.url.String()
+}
+
+func (s *httpSource) Fetch(ctx context.Context, first, last int64, w io.Writer) error {
+	fragment := newHttpFragment(s.url, byteRange{first: first, last: last})
+	return fragment.Start(ctx, s.do, w)
+}
+
+// stat finds out about the object. HTTP sources are probed directly, so that a source without range support can be
+// streamed instead.
+func (r *Granger) stat(ctx context.Context) (*sourceInfo, error) {
+	var info *sourceInfo
+	_, err := r.retryPolicy.Do(ctx, func() error {
+		if source, ok := r.source.(*httpSource); ok {
+			var err error
+			info, err = r.probeRequest(ctx, source)
+			return err
+		}
+		object, err := r.source.Stat(ctx)
+		if err != nil {
+			return err
+		}
+		if object.Size < 0 {
+			return ErrUnknownSize
+		}
+		info = &sourceInfo{ObjectInfo: *object, rangeable: true}
+		return nil
+	})
+	return info, err
+}
+
+// sourceName identifies the source in the resume journal, so that a journal is never resumed against another source.
+func (r *Granger) sourceName() string {
+	if s, ok := r.source.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return ""
+}
+
+// firstByteWriter records when the first bytes were written to it, which tells us the latency of a fetch.
+type firstByteWriter struct {
+	w         io.Writer
+	firstByte time.Time
+}
+
+func (f *firstByteWriter) Write(p []byte) (int, error) {
+	if f.firstByte.IsZero() && len(p) > 0 {
+		f.firstByte = time.Now()
+	}
+	return f.w.Write(p)
+}
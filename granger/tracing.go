@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer starts spans. Its shape matches OpenTelemetry's trace.Tracer closely enough that adapting one is a few
+// lines: Start calls the OpenTelemetry tracer's Start and wraps the span it returns, SetAttribute becomes
+// span.SetAttributes with an attribute.KeyValue, RecordError becomes span.RecordError and span.SetStatus.
+type Tracer interface {
+	// Start starts a span called name as a child of any span in ctx, returning a context which carries it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is an operation being traced.
+type Span interface {
+	SetAttribute(key string, value any)
+	RecordError(err error)
+	End()
+}
+
+// fragmentSpanName is the name of the span traced for each attempt at fetching a fragment.
+const fragmentSpanName = "granger.fragment"
+
+// spanKey is the context key under which tracingObserver keeps the span of an attempt.
+type spanKey struct{}
+
+// NewTracingObserver returns an Observer which traces each attempt at fetching a fragment as a span from tracer.
+// The spans are children of any span in the context passed to WriteToContext or RemoteFile, and the requests of the
+// attempt are made with the span's context, so an instrumented HTTP client can add its own spans beneath them.
+func NewTracingObserver(tracer Tracer) Observer {
+	return tracingObserver{tracer: tracer}
+}
+
+type tracingObserver struct {
+	NopObserver
+	tracer Tracer
+}
+
+func (t tracingObserver) FragmentStarted(ctx context.Context, fragment Fragment, attempt int) context.Context {
+	ctx, span := t.tracer.Start(ctx, fragmentSpanName)
+	span.SetAttribute("granger.fragment.offset", fragment.Offset)
+	span.SetAttribute("granger.fragment.size", fragment.Size)
+	span.SetAttribute("granger.fragment.attempt", attempt)
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+func (t tracingObserver) FragmentCompleted(ctx context.Context, fragment Fragment, stats FragmentStats, err error) {
+	span, ok := ctx.Value(spanKey{}).(Span)
+	if !ok {
+		return
+	}
+	if stats.Latency > 0 {
+		span.SetAttribute("granger.fragment.latency_ms", float64(stats.Latency)/float64(time.Millisecond))
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTracer records the spans it starts.
+type fakeTracer struct {
+	mu    sync.Mutex
+	spans []*fakeSpan
+}
+
+type fakeSpan struct {
+	mu         sync.Mutex
+	name       string
+	parent     *fakeSpan
+	attributes map[string]any
+	err        error
+	ended      bool
+}
+
+type fakeSpanKey struct{}
+
+func (t *fakeTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(fakeSpanKey{}).(*fakeSpan)
+	span := &fakeSpan{name: name, parent: parent, attributes: map[string]any{}}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, fakeSpanKey{}, span), span
+}
+
+func (s *fakeSpan) SetAttribute(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+func (s *fakeSpan) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *fakeSpan) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+}
+
+func TestTracingObserver(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := newFlakyServer(payload, 1, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	tracer := &fakeTracer{}
+	ctx, root := tracer.Start(context.Background(), "download")
+	g := NewGranger(u, WithFragmentSize(8), WithRetryPolicy(3, time.Millisecond, 0),
+		WithObserver(NewTracingObserver(tracer)))
+	_, err = g.WriteToContext(ctx, &bytes.Buffer{})
+	assert.NoError(t, err)
+
+	fragments := tracer.spans[1:]
+	assert.Len(t, fragments, 6)
+	failed := 0
+	for _, span := range fragments {
+		assert.Equal(t, fragmentSpanName, span.name)
+		assert.Same(t, root, span.parent)
+		assert.True(t, span.ended)
+		assert.Equal(t, int64(8), span.attributes["granger.fragment.size"])
+		assert.Contains(t, span.attributes, "granger.fragment.offset")
+		if span.err != nil {
+			failed += 1
+			assert.Equal(t, 1, span.attributes["granger.fragment.attempt"])
+			statusErr := &StatusError{}
+			assert.ErrorAs(t, span.err, &statusErr)
+		} else {
+			assert.Equal(t, 2, span.attributes["granger.fragment.attempt"])
+			assert.Contains(t, span.attributes, "granger.fragment.latency_ms")
+		}
+	}
+	assert.Equal(t, 3, failed)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// Protocol chooses how the requests for fragments share connections to the server.
+type Protocol int
+
+const (
+	// ProtocolAuto uses HTTP/2 if the server offers it over TLS, and HTTP/1.1 otherwise.
+	ProtocolAuto Protocol = iota
+	// ProtocolHTTP1 uses HTTP/1.1, with a connection of its own for each fragment being fetched.
+	ProtocolHTTP1
+	// ProtocolHTTP2 multiplexes every fragment over a single HTTP/2 connection. The server must offer HTTP/2 over
+	// TLS, so plain http sources still use HTTP/1.1.
+	ProtocolHTTP2
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolHTTP1:
+		return "http1"
+	case ProtocolHTTP2:
+		return "http2"
+	}
+	return "auto"
+}
+
+// WithProtocol chooses between HTTP/1.1 and HTTP/2 for the connections to the source and its mirrors. It has no
+// effect if WithHTTPClient is given.
+func WithProtocol(protocol Protocol) Option {
+	return func(g *Granger) {
+		g.protocol = protocol
+	}
+}
+
+// WithMaxConnsPerHost caps how many connections are opened to each host. It defaults to the parallelization, or to
+// the maximum parallelization with WithAdaptiveTuning, so that every fragment fetched at once has a connection and
+// each connection is kept open to be reused by later fragments. It has no effect if WithHTTPClient is given.
+func WithMaxConnsPerHost(maxConns int) Option {
+	return func(g *Granger) {
+		g.maxConnsPerHost = maxConns
+	}
+}
+
+// WithTLSConfig sets the TLS configuration for https connections, e.g. to trust a private CA. It has no effect if
+// WithHTTPClient is given.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(g *Granger) {
+		g.tlsConfig = config
+	}
+}
+
+// newTransport returns a transport for the download. It starts from http.DefaultTransport to keep its dialer, proxy
+// and keep-alive settings, and sizes the connection pool to the number of fragments fetched at once.
+func (r *Granger) newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	conns := r.maxConnsPerHost
+	if conns <= 0 {
+		conns = r.parallelization
+		if r.adaptivePolicy != nil {
+			conns = max(conns, r.adaptivePolicy.MaxParallelization)
+		}
+	}
+	// The default keeps only 2 idle connections per host, so the rest would be closed after each fragment.
+	transport.MaxIdleConnsPerHost = conns
+	transport.MaxIdleConns = max(transport.MaxIdleConns, conns)
+	if r.tlsConfig != nil {
+		transport.TLSClientConfig = r.tlsConfig.Clone()
+	}
+
+	switch r.protocol {
+	case ProtocolHTTP1:
+		// A non-nil, empty TLSNextProto stops the transport from negotiating HTTP/2.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		if transport.TLSClientConfig != nil {
+			transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+		}
+	case ProtocolHTTP2:
+		transport.ForceAttemptHTTP2 = true
+	}
+	transport.MaxConnsPerHost = conns
+	return transport
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tlsServer serves payload over TLS, offering HTTP/2, and counts the connections and the protocols requested with.
+type tlsServer struct {
+	*httptest.Server
+	conns     atomic.Int32
+	mu        sync.Mutex
+	protocols map[string]int
+}
+
+func newTLSServer(payload []byte) *tlsServer {
+	s := &tlsServer{protocols: map[string]int{}}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.protocols[r.Proto] += 1
+		s.mu.Unlock()
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	}))
+	s.EnableHTTP2 = true
+	s.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			s.conns.Add(1)
+		}
+	}
+	s.StartTLS()
+	return s
+}
+
+// tlsConfig trusts the server's certificate.
+func (s *tlsServer) tlsConfig() *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	return &tls.Config{RootCAs: roots}
+}
+
+func TestProtocols(t *testing.T) {
+	payload := randomPayload(64 * 1024)
+	tests := map[Protocol]struct {
+		proto    string
+		maxConns int32
+	}{
+		ProtocolAuto:  {proto: "HTTP/2.0", maxConns: 1},
+		ProtocolHTTP1: {proto: "HTTP/1.1", maxConns: 4},
+		ProtocolHTTP2: {proto: "HTTP/2.0", maxConns: 1},
+	}
+
+	for protocol, test := range tests {
+		t.Run(protocol.String(), func(t *testing.T) {
+			server := newTLSServer(payload)
+			defer server.Close()
+			u, err := url.Parse(server.URL)
+			assert.NoError(t, err)
+
+			g := NewGranger(u, WithFragmentSize(1024), WithParallelization(4), WithProtocol(protocol),
+				WithTLSConfig(server.tlsConfig()))
+			buffer := &bytes.Buffer{}
+			_, err = g.WriteTo(buffer)
+			assert.NoError(t, err)
+			assert.Equal(t, payload, buffer.Bytes())
+
+			// Connections are reused across the 64 fragments.
+			server.mu.Lock()
+			assert.Equal(t, map[string]int{test.proto: 65}, server.protocols)
+			server.mu.Unlock()
+			assert.LessOrEqual(t, server.conns.Load(), test.maxConns)
+		})
+	}
+}
+
+func TestTransportConnectionLimits(t *testing.T) {
+	u, err := url.Parse("https://example.com")
+	assert.NoError(t, err)
+	g := NewGranger(u, WithParallelization(8), WithProtocol(ProtocolHTTP1))
+	transport := g.httpClient.(*http.Client).Transport.(*http.Transport)
+	assert.Equal(t, 8, transport.MaxConnsPerHost)
+	assert.Equal(t, 8, transport.MaxIdleConnsPerHost)
+	assert.False(t, transport.ForceAttemptHTTP2)
+	// The defaults are kept.
+	assert.NotNil(t, transport.Proxy)
+	assert.NotNil(t, transport.DialContext)
+
+	g = NewGranger(u, WithParallelization(2), WithAdaptiveTuning(AdaptivePolicy{MaxParallelization: 16}))
+	assert.Equal(t, 16, g.httpClient.(*http.Client).Transport.(*http.Transport).MaxConnsPerHost)
+
+	g = NewGranger(u, WithParallelization(2), WithMaxConnsPerHost(3))
+	assert.Equal(t, 3, g.httpClient.(*http.Client).Transport.(*http.Transport).MaxConnsPerHost)
+
+	client := &http.Client{}
+	g = NewGranger(u, WithHTTPClient(client), WithProtocol(ProtocolHTTP2))
+	assert.Same(t, client, g.httpClient)
+}
+
+func BenchmarkProtocols(b *testing.B) {
+	payload := randomPayload(16 * 1024 * 1024)
+	for _, protocol := range []Protocol{ProtocolHTTP1, ProtocolHTTP2} {
+		b.Run(protocol.String(), func(b *testing.B) {
+			server := newTLSServer(payload)
+			defer server.Close()
+			u, err := url.Parse(server.URL)
+			assert.NoError(b, err)
+
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				g := NewGranger(u, WithFragmentSize(256*1024), WithParallelization(8), WithProtocol(protocol),
+					WithTLSConfig(server.tlsConfig()))
+				_, err := g.WriteTo(io.Discard)
+				assert.NoError(b, err)
+			}
+			b.ReportMetric(float64(server.conns.Load())/float64(b.N), "conns/op")
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// throughputTolerance is how much the aggregate throughput has to change by before we consider it better or
+	// worse, so that noise doesn't cause us to flip-flop.
+	throughputTolerance = 0.05
+	// latencyRatio is how many times longer than the time to first byte we want each fragment's transfer to take,
+	// which keeps request overhead to roughly 10% of each fragment.
+	latencyRatio = 9
+	// minFragmentDuration stops fragments from becoming so small that they finish before we can measure them.
+	minFragmentDuration = 250 * time.Millisecond
+)
+
+// AdaptivePolicy bounds how far the fragment size and parallelization may be tuned. A bound left at zero is replaced
+// by the starting value, so that a policy which only bounds the parallelization leaves the fragment size alone.
+type AdaptivePolicy struct {
+	MinFragmentSize    int
+	MaxFragmentSize    int
+	MinParallelization int
+	MaxParallelization int
+}
+
+// tuner measures completed fragments and adjusts the fragment size and parallelization towards the best aggregate
+// bandwidth. Parallelization is tuned by hill climbing: we keep stepping in the same direction while throughput
+// improves and reverse when it gets worse. The fragment size is tuned so that request latency is a small fraction
+// of the time spent transferring each fragment.
+type tuner struct {
+	policy AdaptivePolicy
+	// setParallelization is called whenever the parallelization changes.
+	setParallelization func(int)
+	now                func() time.Time
+
+	mu              sync.Mutex
+	fragmentSize    int
+	parallelization int
+	// step is the direction the parallelization is currently moving in.
+	step           int
+	lastThroughput float64
+
+	// The current measurement window.
+	windowStart     time.Time
+	windowFragments int
+	windowBytes     int64
+	latency         time.Duration
+	transfer        time.Duration
+}
+
+func newTuner(policy AdaptivePolicy, fragmentSize, parallelization int, setParallelization func(int)) *tuner {
+	policy.MinFragmentSize, policy.MaxFragmentSize = bounds(policy.MinFragmentSize, policy.MaxFragmentSize, fragmentSize)
+	policy.MinParallelization, policy.MaxParallelization = bounds(policy.MinParallelization, policy.MaxParallelization,
+		parallelization)
+	t := &tuner{
+		policy:             policy,
+		setParallelization: setParallelization,
+		now:                time.Now,
+		fragmentSize:       clamp(fragmentSize, policy.MinFragmentSize, policy.MaxFragmentSize),
+		parallelization:    clamp(parallelization, policy.MinParallelization, policy.MaxParallelization),
+		step:               1,
+	}
+	t.windowStart = t.now()
+	setParallelization(t.parallelization)
+
+	return t
+}
+
+// FragmentSize returns the size to use for the next fragment.
+func (t *tuner) FragmentSize() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.fragmentSize
+}
+
+// Parallelization returns the number of fragments to fetch at once.
+func (t *tuner) Parallelization() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.parallelization
+}
+
+// Observe records a completed fragment of n bytes, which took latency to receive the first byte and elapsed in
+// total. Once a window of fragments has been observed, the fragment size and parallelization are adjusted.
+func (t *tuner) Observe(n int64, latency, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.windowFragments += 1
+	t.windowBytes += n
+	t.latency += latency
+	t.transfer += elapsed - latency
+	if t.windowFragments < t.parallelization {
+		return
+	}
+
+	now := t.now()
+	if wall := now.Sub(t.windowStart); wall > 0 {
+		t.tuneParallelization(float64(t.windowBytes) / wall.Seconds())
+	}
+	if t.transfer > 0 {
+		avgLatency := t.latency / time.Duration(t.windowFragments)
+		rate := float64(t.windowBytes) / t.transfer.Seconds()
+		t.tuneFragmentSize(avgLatency, rate)
+	}
+
+	t.windowStart = now
+	t.windowFragments = 0
+	t.windowBytes = 0
+	t.latency = 0
+	t.transfer = 0
+}
+
+func (t *tuner) tuneParallelization(throughput float64) {
+	if throughput < t.lastThroughput*(1-throughputTolerance) {
+		// The last change made things worse, so go back the other way.
+		t.step = -t.step
+	} else if throughput <= t.lastThroughput*(1+throughputTolerance) {
+		// No meaningful difference, so stay where we are.
+		t.lastThroughput = throughput
+		return
+	}
+	t.lastThroughput = throughput
+
+	next := clamp(t.parallelization+t.step, t.policy.MinParallelization, t.policy.MaxParallelization)
+	if next == t.parallelization {
+		// We've hit a bound, so the only way to explore is back the other way.
+		t.step = -t.step
+		return
+	}
+	t.parallelization = next
+	t.setParallelization(next)
+}
+
+func (t *tuner) tuneFragmentSize(latency time.Duration, rate float64) {
+	target := max(latency*latencyRatio, minFragmentDuration)
+	size := int(rate * target.Seconds())
+	// Move gradually, so that a single noisy window can't swing the size too far.
+	size = clamp(size, t.fragmentSize/2, t.fragmentSize*2)
+	t.fragmentSize = clamp(size, t.policy.MinFragmentSize, t.policy.MaxFragmentSize)
+}
+
+// bounds fills in the bounds lo and hi which were left at zero with start, and makes sure neither is below 1.
+func bounds(lo, hi, start int) (int, int) {
+	if lo <= 0 {
+		lo = start
+	}
+	if hi <= 0 {
+		hi = start
+	}
+	lo = max(lo, 1)
+	return lo, max(hi, lo)
+}
+
+func clamp(v, lo, hi int) int {
+	return max(lo, min(v, hi))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// fakeClock lets tests decide how much wall time each measurement window takes.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestTuner(policy AdaptivePolicy, fragmentSize, parallelization int) (*tuner, *fakeClock, *[]int) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	changes := &[]int{}
+	t := newTuner(policy, fragmentSize, parallelization, func(p int) {
+		*changes = append(*changes, p)
+	})
+	t.now = clock.Now
+	t.windowStart = clock.now
+	return t, clock, changes
+}
+
+// runWindow observes a full window of fragments which took wall time in aggregate.
+func runWindow(t *tuner, clock *fakeClock, fragmentSize int, latency, elapsed, wall time.Duration) {
+	clock.now = clock.now.Add(wall)
+	for i := t.Parallelization(); i > 0; i-- {
+		t.Observe(int64(fragmentSize), latency, elapsed)
+	}
+}
+
+func TestTunerGrowsParallelizationWhileThroughputImproves(t *testing.T) {
+	policy := AdaptivePolicy{MinFragmentSize: MiB, MaxFragmentSize: MiB, MinParallelization: 1, MaxParallelization: 4}
+	tuner, clock, changes := newTestTuner(policy, MiB, 1)
+
+	// Every window takes the same wall time, so more fragments per window means more throughput.
+	for i := 0; i < 10; i++ {
+		runWindow(tuner, clock, MiB, 0, time.Second, time.Second)
+	}
+
+	assert.Equal(t, 4, tuner.Parallelization())
+	assert.Equal(t, []int{1, 2, 3, 4}, (*changes)[:4])
+}
+
+func TestTunerBacksOffWhenThroughputDrops(t *testing.T) {
+	policy := AdaptivePolicy{MinFragmentSize: MiB, MaxFragmentSize: MiB, MinParallelization: 1, MaxParallelization: 8}
+	tuner, clock, _ := newTestTuner(policy, MiB, 2)
+
+	runWindow(tuner, clock, MiB, 0, time.Second, time.Second)
+	assert.Equal(t, 3, tuner.Parallelization())
+
+	// Adding a connection saturated the link and made things slower.
+	runWindow(tuner, clock, MiB, 0, time.Second, 3*time.Second)
+	assert.Equal(t, 2, tuner.Parallelization())
+}
+
+func TestTunerFragmentSize(t *testing.T) {
+	policy := AdaptivePolicy{MinFragmentSize: MiB, MaxFragmentSize: 64 * MiB, MinParallelization: 1, MaxParallelization: 1}
+
+	// High latency relative to the transfer time should grow the fragments, up to double each window.
+	tuner, clock, _ := newTestTuner(policy, 4*MiB, 1)
+	runWindow(tuner, clock, 4*MiB, 500*time.Millisecond, 600*time.Millisecond, time.Second)
+	assert.Equal(t, 8*MiB, tuner.FragmentSize())
+
+	// Fragments which take a long time to transfer with little latency should shrink.
+	tuner, clock, _ = newTestTuner(policy, 32*MiB, 1)
+	runWindow(tuner, clock, 32*MiB, time.Millisecond, 10*time.Second, 10*time.Second)
+	assert.Equal(t, 16*MiB, tuner.FragmentSize())
+
+	// The size never leaves the bounds of the policy.
+	for i := 0; i < 10; i++ {
+		runWindow(tuner, clock, tuner.FragmentSize(), time.Millisecond, 10*time.Second, 10*time.Second)
+	}
+	assert.Equal(t, MiB, tuner.FragmentSize())
+}
+
+func TestTunerZeroBounds(t *testing.T) {
+	// Bounds left at zero stay at the starting values.
+	tuner, _, _ := newTestTuner(AdaptivePolicy{MaxParallelization: 8}, MiB, 2)
+	assert.Equal(t, AdaptivePolicy{
+		MinFragmentSize:    MiB,
+		MaxFragmentSize:    MiB,
+		MinParallelization: 2,
+		MaxParallelization: 8,
+	}, tuner.policy)
+
+	tuner, _, _ = newTestTuner(AdaptivePolicy{MinFragmentSize: 4 * MiB}, MiB, 0)
+	assert.Equal(t, AdaptivePolicy{
+		MinFragmentSize:    4 * MiB,
+		MaxFragmentSize:    4 * MiB,
+		MinParallelization: 1,
+		MaxParallelization: 1,
+	}, tuner.policy)
+	assert.Equal(t, 4*MiB, tuner.FragmentSize())
+}
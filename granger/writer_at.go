@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"pipeline"
+	"sync"
+)
+
+// WriteToAt writes the source to w, writing each fragment at its offset as soon as it arrives rather than waiting
+// for the fragments before it. WriteTo does this automatically when given a regular file.
+func (r *Granger) WriteToAt(w io.WriterAt) (int64, error) {
+	return r.WriteToAtContext(context.Background(), w)
+}
+
+// WriteToAtContext is like WriteToAt, but stops fetching fragments and returns an error once ctx is cancelled.
+func (r *Granger) WriteToAtContext(ctx context.Context, w io.WriterAt) (int64, error) {
+	info, err := r.stat(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if !info.rangeable {
+		return r.stream(ctx, io.NewOffsetWriter(w, 0), info)
+	}
+	return r.writeToAt(ctx, w, info)
+}
+
+// writerAtFor returns w as an io.WriterAt if it can be written out of order. Pipes and terminals can't be written
+// at an offset, files opened for appending refuse to be, and a file which isn't at its start expects us to write
+// from where it is, so those are all written in order instead.
+func writerAtFor(w io.Writer) (io.WriterAt, bool) {
+	f, ok := w.(*os.File)
+	if !ok {
+		wa, ok := w.(io.WriterAt)
+		return wa, ok
+	}
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, false
+	}
+	if _, err := f.WriteAt(nil, 0); err != nil {
+		return nil, false
+	}
+	if pos, err := f.Seek(0, io.SeekCurrent); err != nil || pos != 0 {
+		return nil, false
+	}
+	return f, true
+}
+
+func (r *Granger) writeToAt(ctx context.Context, w io.WriterAt, info *sourceInfo) (int64, error) {
+	totalSize := info.Size
+	gaps := []journalRange{{Start: 0, End: totalSize}}
+	var journal *Journal
+	if r.journalPath != "" {
+		var err error
+		journal, err = r.openJournal(info)
+		if err != nil {
+			return 0, err
+		}
+		gaps = journal.Gaps(totalSize)
+	}
+	closeAll := func() {
+		if journal != nil {
+			_ = journal.Close()
+		}
+	}
+
+	var verifier *verifier
+	if r.verifyChecksums || len(r.expectedDigests) > 0 {
+		// The fragments arrive out of order, so the checksum is computed by reading the file back at the end.
+		if _, ok := w.(io.ReaderAt); !ok {
+			closeAll()
+			return 0, errors.New("unable to verify checksum, destination is not readable")
+		}
+		var err error
+		if verifier, err = r.newVerifier(info.Digests, nil, 0); err != nil {
+			closeAll()
+			return 0, err
+		}
+	}
+	if err := preallocate(w, totalSize); err != nil {
+		closeAll()
+		return 0, err
+	}
+
+	semaphore := pipeline.NewSemaphore(r.parallelization)
+	var tuner *tuner
+	if r.adaptivePolicy != nil {
+		fragmentSize := r.fragmentSize
+		if fragmentSize == 0 {
+			fragmentSize = int(totalSize)
+		}
+		tuner = newTuner(*r.adaptivePolicy, fragmentSize, r.parallelization, semaphore.SetLimit)
+	}
+	remaining := int64(0)
+	for _, gap := range gaps {
+		remaining += gap.End - gap.Start
+	}
+	d := &download{
+		journal:  journal,
+		tuner:    tuner,
+		mirrors:  r.newMirrorSet(ctx, info),
+		buffers:  newBufferPool(r.maxBuffered),
+		progress: r.newProgress(totalSize-remaining, totalSize),
+	}
+
+	// Like an errgroup, the first fragment to fail cancels the rest.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	wg := sync.WaitGroup{}
+	var firstErr error
+	errOnce := sync.Once{}
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel(err)
+		})
+	}
+
+	written := int64(0)
+fragments:
+	for _, gap := range gaps {
+		planner := newFragmentPlanner(gap.Start, gap.End, r.fragmentSizer(tuner, info.Parts))
+		for rng, ok := planner.Next(); ok; rng, ok = planner.Next() {
+			fragment := newHttpFragment(r.srcUrl, rng)
+			buffer, err := d.buffers.Get(ctx, int(rng.size()))
+			if err == nil {
+				if err = semaphore.AcquireContext(ctx); err != nil {
+					d.buffers.Put(buffer, int(rng.size()))
+				}
+			}
+			if err != nil {
+				fail(context.Cause(ctx))
+				break fragments
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer semaphore.Release()
+				if err := r.writeFragmentAt(ctx, fragment, buffer, w, d); err != nil {
+					fail(err)
+				}
+			}()
+			written += rng.size()
+		}
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		if journal != nil {
+			_ = journal.Close()
+		}
+		return 0, firstErr
+	}
+	if verifier != nil {
+		if _, err := io.Copy(verifier, io.NewSectionReader(w.(io.ReaderAt), 0, totalSize)); err != nil {
+			closeAll()
+			return written, err
+		}
+		if err := r.verify(verifier, journal); err != nil {
+			return written, err
+		}
+	}
+	if journal != nil {
+		if err := journal.Remove(); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// writeFragmentAt fetches fragment and writes it to w at its offset.
+func (r *Granger) writeFragmentAt(ctx context.Context, fragment *HttpFragment, buffer *bytes.Buffer, w io.WriterAt,
+	d *download) error {
+	defer d.buffers.Put(buffer, fragment.endPos-fragment.startPos)
+
+	if err := r.fetchFragment(ctx, fragment, buffer, d); err != nil {
+		return err
+	}
+	n, err := w.WriteAt(buffer.Bytes(), int64(fragment.startPos))
+	if err != nil {
+		return err
+	}
+	d.progress.Add(int64(n))
+	if d.journal != nil {
+		return d.journal.Commit(int64(fragment.startPos), int64(fragment.endPos))
+	}
+	return nil
+}
+
+// preallocate sizes a destination file for the whole source before any fragments are written.
+func preallocate(w io.WriterAt, size int64) error {
+	f, ok := w.(*os.File)
+	if !ok || size == 0 {
+		return nil
+	}
+	if err := fallocate(f, size); err != nil {
+		return err
+	}
+	// Reserving space never shrinks a file, so drop anything left over from a larger download.
+	return f.Truncate(size)
+}
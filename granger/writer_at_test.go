@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingWriterAt is an in-memory io.WriterAt which remembers the order of the offsets written to.
+type recordingWriterAt struct {
+	mu      sync.Mutex
+	data    []byte
+	offsets []int64
+}
+
+func (w *recordingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if end := int(off) + len(p); end > len(w.data) {
+		w.data = append(w.data, make([]byte, end-len(w.data))...)
+	}
+	copy(w.data[off:], p)
+	w.offsets = append(w.offsets, off)
+	return len(p), nil
+}
+
+func TestWriteToAtOutOfOrder(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hold up the first fragment so that everything else arrives before it.
+		if rng := r.Header.Get("Range"); strings.HasPrefix(rng, "bytes=0-") && rng != "bytes=0-0" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	g := NewGranger(u, WithFragmentSize(8), WithParallelization(3))
+	w := &recordingWriterAt{}
+	n, err := g.WriteToAt(w)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(payload)), n)
+	assert.Equal(t, payload, w.data)
+	assert.Equal(t, int64(0), w.offsets[len(w.offsets)-1])
+}
+
+func TestWriteToDetectsFiles(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := newTestServer(payload, serverConfig{})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	// A stale file which is bigger than the source should be trimmed down.
+	path := filepath.Join(t.TempDir(), "out")
+	assert.NoError(t, os.WriteFile(path, bytes.Repeat([]byte("x"), 100), 0644))
+	out, err := os.OpenFile(path, os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	defer out.Close()
+
+	sum := sha256.Sum256(payload)
+	g := NewGranger(u, WithFragmentSize(5), WithParallelization(3), WithExpectedDigest(AlgorithmSHA256, sum[:]))
+	_, ok := writerAtFor(out)
+	assert.True(t, ok)
+	_, err = g.WriteTo(out)
+	assert.NoError(t, err)
+
+	// The file is left where it would be had it been written in order.
+	pos, err := out.Seek(0, io.SeekCurrent)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(payload)), pos)
+
+	written, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, written)
+}
+
+func TestWriteToFallsBackForAppendOnlyFiles(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	server := newTestServer(payload, serverConfig{})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "out")
+	assert.NoError(t, os.WriteFile(path, []byte("header:"), 0644))
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	defer out.Close()
+
+	_, ok := writerAtFor(out)
+	assert.False(t, ok)
+
+	g := NewGranger(u, WithFragmentSize(8), WithParallelization(3))
+	_, err = g.WriteTo(out)
+	assert.NoError(t, err)
+
+	written, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, append([]byte("header:"), payload...), written)
+}
+
+func TestWriteToAtResumesGaps(t *testing.T) {
+	payload := []byte("hello world, granger!!!!")
+	rangeRequests := &atomic.Int32{}
+	server := newTestServer(payload, serverConfig{etag: `"v1"`, ranged: rangeRequests})
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "out.journal")
+	journal, err := OpenJournal(journalPath)
+	assert.NoError(t, err)
+	assert.NoError(t, journal.Reset(u.String(), `"v1"`, "", int64(len(payload))))
+	assert.NoError(t, journal.Commit(8, 16))
+	assert.NoError(t, journal.Close())
+
+	// Only the middle fragment made it to disk before we were interrupted.
+	path := filepath.Join(dir, "out")
+	assert.NoError(t, os.WriteFile(path, append(make([]byte, 8), payload[8:16]...), 0644))
+	out, err := os.OpenFile(path, os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	defer out.Close()
+
+	g := NewGranger(u, WithFragmentSize(8), WithParallelization(2), WithResumeJournal(journalPath))
+	n, err := g.WriteTo(out)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(16), n)
+	assert.Equal(t, int32(3), rangeRequests.Load())
+
+	written, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, written)
+}
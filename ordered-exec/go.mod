@@ -1,3 +1,7 @@
 module ordered
 
 go 1.22
+
+require pipeline v0.0.0
+
+replace pipeline => ../pipeline
@@ -0,0 +1,148 @@
+package pipeline
+
+import (
+	"context"
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	defaultHedgePercentile = 0.95
+	defaultHedgeMinSamples = 5
+	// durationSamples is how many of the most recent job durations the hedging deadline is estimated from.
+	durationSamples = 128
+)
+
+// HedgePolicy describes when a straggling job is hedged by starting a duplicate of it.
+type HedgePolicy struct {
+	// Percentile, between 0 and 1, of recent job durations which the job at the head of the line may run for before
+	// it is hedged. Defaults to 0.95.
+	Percentile float64
+	// MinDelay is the least time a job runs before it is hedged, however quick other jobs have been.
+	MinDelay time.Duration
+	// MinSamples is how many jobs must have completed before the percentile is trusted. Until then, jobs are hedged
+	// after MinDelay, or not at all if it is zero. Defaults to 5.
+	MinSamples int
+}
+
+// WithHedging hedges the job at the head of the line, which every later callback is waiting on, once it has run for
+// longer than policy allows: a duplicate is started, whichever finishes first is used, and the other is cancelled.
+// Only jobs submitted with Idempotent are hedged. A hedge runs on top of the parallelization, but there is only ever
+// one at a time, as only the head job is hedged.
+func WithHedging(policy HedgePolicy) Option {
+	return func(p *Processor) {
+		if policy.Percentile <= 0 || policy.Percentile > 1 {
+			policy.Percentile = defaultHedgePercentile
+		}
+		if policy.MinSamples <= 0 {
+			policy.MinSamples = defaultHedgeMinSamples
+		}
+		p.hedging = &policy
+	}
+}
+
+// JobOption changes how a single job is run.
+type JobOption func(j *jobConfig)
+
+type jobConfig struct {
+	idempotent bool
+	key        string
+	urgent     bool
+}
+
+// Idempotent marks a job as safe to run more than once, and more than once at the same time, so that it can be
+// hedged. Each run is passed its own context, which is cancelled if another run finishes first.
+func Idempotent() JobOption {
+	return func(j *jobConfig) {
+		j.idempotent = true
+	}
+}
+
+// Key sets the key of a job, whose callback runs in order with those of the other jobs with the same key if the
+// processor was made with WithKeyedOrdering. It is ignored otherwise.
+func Key(key string) JobOption {
+	return func(j *jobConfig) {
+		j.key = key
+	}
+}
+
+// Urgent lets a job skip ahead of other jobs waiting for capacity, if the processor was made with WithPriorityLanes.
+// It is ignored otherwise.
+func Urgent() JobOption {
+	return func(j *jobConfig) {
+		j.urgent = true
+	}
+}
+
+// attemptKey is the context key under which a job's run is numbered.
+type attemptKey struct{}
+
+// Attempt returns 0 for the first run of the job whose context is ctx, and 1 for a hedged duplicate of it. A job can
+// use it to avoid sharing state, such as a buffer, with the run it is racing.
+func Attempt(ctx context.Context) int {
+	attempt, _ := ctx.Value(attemptKey{}).(int)
+	return attempt
+}
+
+// hedgeable is a running job which may be hedged.
+type hedgeable interface {
+	startedAt() time.Time
+	hedge() bool
+}
+
+// hedgeDelay returns how long the head job may run before it is hedged, or false if it shouldn't be hedged yet. p.mu
+// must be held.
+func (p *Processor) hedgeDelay() (time.Duration, bool) {
+	if len(p.durations) < p.hedging.MinSamples {
+		return p.hedging.MinDelay, p.hedging.MinDelay > 0
+	}
+	sorted := slices.Clone(p.durations)
+	slices.Sort(sorted)
+	i := int(math.Ceil(p.hedging.Percentile*float64(len(sorted)))) - 1
+	return max(sorted[max(i, 0)], p.hedging.MinDelay), true
+}
+
+// recordDuration remembers how long a job took, to estimate the hedging deadline from. p.mu must be held.
+func (p *Processor) recordDuration(d time.Duration) {
+	if len(p.durations) < durationSamples {
+		p.durations = append(p.durations, d)
+		return
+	}
+	p.durations[p.nextDuration] = d
+	p.nextDuration = (p.nextDuration + 1) % durationSamples
+}
+
+// armHedge arranges for the job with sequence number seq in stream s to be hedged if it is still running at the head
+// of the line once the deadline passes. It returns the timer, or nil if the job won't be hedged.
+func (p *Processor) armHedge(s *stream, seq int64) *time.Timer {
+	p.mu.Lock()
+	delay, ok := p.hedgeDelay()
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return time.AfterFunc(delay, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if seq == s.nextCallback {
+			p.hedgeHead(s)
+		}
+	})
+}
+
+// hedgeHead hedges the head job of stream s if it is running, hedgeable and past its deadline. It is called when the
+// deadline passes and whenever a new job reaches the head of the line. p.mu must be held.
+func (p *Processor) hedgeHead(s *stream) {
+	head, ok := s.running[s.nextCallback]
+	if !ok {
+		return
+	}
+	delay, ok := p.hedgeDelay()
+	if !ok || time.Since(head.startedAt()) < delay {
+		return
+	}
+	if head.hedge() {
+		p.stats.Hedges += 1
+	}
+}
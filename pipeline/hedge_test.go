@@ -0,0 +1,151 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// straggler returns a job whose first run hangs until it is cancelled, and whose hedged run returns "hedge".
+// cancelled is closed once the first run has been cancelled.
+func straggler(cancelled chan struct{}) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		if Attempt(ctx) == 0 {
+			<-ctx.Done()
+			close(cancelled)
+			return "", ctx.Err()
+		}
+		return "hedge", nil
+	}
+}
+
+func TestHedging(t *testing.T) {
+	checkGoroutines(t)
+	p := New(4, WithHedging(HedgePolicy{Percentile: 0.5, MinSamples: 5}))
+	results := []string{}
+	cb := func(result string) error {
+		results = append(results, result)
+		return nil
+	}
+
+	// Quick jobs give an idea of how long a job should take. They aren't idempotent, so they're never hedged.
+	for i := 0; i < 10; i++ {
+		err := Submit(context.Background(), p, func(ctx context.Context) (string, error) {
+			time.Sleep(time.Millisecond)
+			return "quick", nil
+		}, cb)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, p.Wait())
+
+	cancelled := make(chan struct{})
+	assert.NoError(t, Submit(context.Background(), p, straggler(cancelled), cb, Idempotent()))
+	assert.NoError(t, p.Wait())
+	<-cancelled
+	assert.Equal(t, "hedge", results[10])
+	stats := p.Stats()
+	assert.Equal(t, int64(1), stats.Hedges)
+	assert.Equal(t, int64(1), stats.HedgeWins)
+}
+
+func TestHedgingOriginalWins(t *testing.T) {
+	checkGoroutines(t)
+	p := New(1, WithHedging(HedgePolicy{MinDelay: 10 * time.Millisecond}))
+	hedgeCancelled := make(chan struct{})
+	var result string
+	err := Submit(context.Background(), p, func(ctx context.Context) (string, error) {
+		if Attempt(ctx) == 0 {
+			time.Sleep(50 * time.Millisecond)
+			return "original", nil
+		}
+		<-ctx.Done()
+		close(hedgeCancelled)
+		return "", ctx.Err()
+	}, func(r string) error {
+		result = r
+		return nil
+	}, Idempotent())
+	assert.NoError(t, err)
+	assert.NoError(t, p.Wait())
+	<-hedgeCancelled
+	assert.Equal(t, "original", result)
+	assert.Equal(t, int64(1), p.Stats().Hedges)
+	assert.Equal(t, int64(0), p.Stats().HedgeWins)
+}
+
+func TestHedgingFailedRun(t *testing.T) {
+	p := New(1, WithHedging(HedgePolicy{MinDelay: 10 * time.Millisecond}))
+	var result string
+	err := Submit(context.Background(), p, func(ctx context.Context) (string, error) {
+		if Attempt(ctx) == 0 {
+			// Fail once the hedge has started, which still has a chance to succeed.
+			time.Sleep(30 * time.Millisecond)
+			return "", errors.New("original failed")
+		}
+		time.Sleep(40 * time.Millisecond)
+		return "hedge", nil
+	}, func(r string) error {
+		result = r
+		return nil
+	}, Idempotent())
+	assert.NoError(t, err)
+	assert.NoError(t, p.Wait())
+	assert.Equal(t, "hedge", result)
+}
+
+func TestHedgingOnlyIdempotentJobs(t *testing.T) {
+	p := New(1, WithHedging(HedgePolicy{MinDelay: time.Millisecond}))
+	runs := 0
+	err := Submit(context.Background(), p, func(ctx context.Context) (string, error) {
+		runs += 1
+		time.Sleep(30 * time.Millisecond)
+		return "", nil
+	}, func(string) error {
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, p.Wait())
+	assert.Equal(t, 1, runs)
+	assert.Equal(t, int64(0), p.Stats().Hedges)
+}
+
+func TestHedgingNewHead(t *testing.T) {
+	checkGoroutines(t)
+	p := New(2, WithHedging(HedgePolicy{MinDelay: 10 * time.Millisecond}))
+	results := []string{}
+	cb := func(result string) error {
+		results = append(results, result)
+		return nil
+	}
+
+	// Job 1 passes its deadline while job 0 is still at the head of the line, so is hedged as soon as it gets there.
+	assert.NoError(t, Submit(context.Background(), p, func(ctx context.Context) (string, error) {
+		time.Sleep(50 * time.Millisecond)
+		return "slow", nil
+	}, cb))
+	cancelled := make(chan struct{})
+	assert.NoError(t, Submit(context.Background(), p, straggler(cancelled), cb, Idempotent()))
+	assert.NoError(t, p.Wait())
+	<-cancelled
+	assert.Equal(t, []string{"slow", "hedge"}, results)
+}
+
+func TestHedgeDelay(t *testing.T) {
+	p := New(1, WithHedging(HedgePolicy{Percentile: 0.9, MinSamples: 3, MinDelay: 5 * time.Millisecond}))
+	_, ok := p.hedgeDelay()
+	assert.True(t, ok)
+
+	for i := 1; i <= 10; i++ {
+		p.recordDuration(time.Duration(i) * time.Millisecond)
+	}
+	delay, ok := p.hedgeDelay()
+	assert.True(t, ok)
+	assert.Equal(t, 9*time.Millisecond, delay)
+
+	// Without a minimum delay, nothing is hedged until there are enough samples.
+	p = New(1, WithHedging(HedgePolicy{}))
+	_, ok = p.hedgeDelay()
+	assert.False(t, ok)
+}
@@ -0,0 +1,181 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyedOrdering(t *testing.T) {
+	checkGoroutines(t)
+	p := New(8, WithKeyedOrdering(), WithReorderWindow(64))
+	keys := []string{"a", "b", "c", "d"}
+	var mu sync.Mutex
+	results := map[string][]int{}
+	for i := 0; i < 200; i++ {
+		key := keys[rand.Intn(len(keys))]
+		delay := time.Duration(rand.Intn(1000)) * time.Microsecond
+		err := Submit(context.Background(), p, func(ctx context.Context) (int, error) {
+			time.Sleep(delay)
+			return i, nil
+		}, func(result int) error {
+			mu.Lock()
+			defer mu.Unlock()
+			results[key] = append(results[key], result)
+			return nil
+		}, Key(key))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, p.Wait())
+
+	total := 0
+	for key, got := range results {
+		assert.IsIncreasing(t, got, "key %s", key)
+		total += len(got)
+	}
+	assert.Equal(t, 200, total)
+	// Idle keys are forgotten.
+	assert.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.streams) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestKeyedOrderingSlowKey(t *testing.T) {
+	checkGoroutines(t)
+	p := New(4, WithKeyedOrdering())
+	release := make(chan struct{})
+	var mu sync.Mutex
+	results := []string{}
+	cb := func(result string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, result)
+		return nil
+	}
+	job := func(result string) func(ctx context.Context) (string, error) {
+		return func(ctx context.Context) (string, error) {
+			if result == "slow0" {
+				<-release
+			}
+			return result, nil
+		}
+	}
+
+	// The slow key fills its reorder window, which is as big as the parallelization.
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, Submit(context.Background(), p, job(fmt.Sprintf("slow%d", i)), cb, Key("slow")))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, Submit(ctx, p, job("slow4"), cb, Key("slow")), context.DeadlineExceeded)
+
+	// The stuck job holds up only the jobs and callbacks with its own key.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 8; i++ {
+		assert.NoError(t, Submit(ctx, p, job(fmt.Sprintf("fast%d", i)), cb, Key("fast")))
+	}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(results) == 8
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"fast0", "fast1", "fast2", "fast3", "fast4", "fast5", "fast6", "fast7"}, results)
+	stats := p.Stats()
+	assert.Equal(t, 1, stats.Running)
+	assert.Equal(t, 3, stats.Waiting)
+
+	close(release)
+	assert.NoError(t, p.Wait())
+	assert.Equal(t, []string{"slow0", "slow1", "slow2", "slow3"}, results[8:])
+}
+
+func TestKeyIgnoredWithoutKeyedOrdering(t *testing.T) {
+	p := New(4)
+	results := []int{}
+	for i := 0; i < 20; i++ {
+		err := Submit(context.Background(), p, func(ctx context.Context) (int, error) {
+			time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+			return i, nil
+		}, func(result int) error {
+			results = append(results, result)
+			return nil
+		}, Key(fmt.Sprint(i%3)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, p.Wait())
+	assert.IsIncreasing(t, results)
+}
+
+// waitingUrgent returns how many urgent callers are waiting for s.
+func waitingUrgent(s *Semaphore) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.urgent
+}
+
+func TestPriorityLanes(t *testing.T) {
+	for _, priority := range []bool{false, true} {
+		t.Run(fmt.Sprintf("priority=%v", priority), func(t *testing.T) {
+			checkGoroutines(t)
+			options := []Option{}
+			if priority {
+				options = append(options, WithPriorityLanes())
+			}
+			p := New(1, options...)
+			release := make(chan struct{})
+			var mu sync.Mutex
+			started := []string{}
+			job := func(name string) func(ctx context.Context) (string, error) {
+				return func(ctx context.Context) (string, error) {
+					mu.Lock()
+					started = append(started, name)
+					mu.Unlock()
+					if name == "busy" {
+						<-release
+					}
+					return name, nil
+				}
+			}
+			cb := func(string) error {
+				return nil
+			}
+			assert.NoError(t, Submit(context.Background(), p, job("busy"), cb))
+
+			var wg sync.WaitGroup
+			submit := func(name string, options ...JobOption) {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					assert.NoError(t, Submit(context.Background(), p, job(name), cb, options...))
+				}()
+			}
+			submit("normal")
+			// Give the normal job time to start waiting, so that it is ahead of the urgent one.
+			time.Sleep(10 * time.Millisecond)
+			submit("urgent", Urgent())
+			if priority {
+				assert.Eventually(t, func() bool {
+					return waitingUrgent(p.window) == 1
+				}, time.Second, time.Millisecond)
+			} else {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			close(release)
+			wg.Wait()
+			assert.NoError(t, p.Wait())
+			if priority {
+				assert.Equal(t, []string{"busy", "urgent", "normal"}, started)
+			} else {
+				assert.Len(t, started, 3)
+			}
+		})
+	}
+}
@@ -0,0 +1,539 @@
+// Package pipeline runs jobs in parallel, but hands their results to callbacks in the order the jobs were submitted.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrStopped is returned by Submit once the processor has been stopped.
+var ErrStopped = errors.New("pipeline: processor stopped")
+
+// Processor will process jobs in the order that they are submitted. If a job or callback fails, outstanding jobs are
+// cancelled and no further callbacks are run. Callbacks are run one at a time, by whichever job's goroutine completes
+// the next job in order, so a Processor has no goroutines of its own to leak. With WithKeyedOrdering, that holds for
+// each key separately.
+type Processor struct {
+	// mu guards the fields below it.
+	mu sync.Mutex
+	// streams holds the jobs of each key which are outstanding. Without WithKeyedOrdering, every job has the same key.
+	streams map[string]*stream
+	stopped bool
+	stats   Stats
+	// keyed and priority are set by WithKeyedOrdering and WithPriorityLanes.
+	keyed    bool
+	priority bool
+	// semaphore allows only n jobs to run at once. A job's slot is released as soon as it completes.
+	semaphore *Semaphore
+	// window limits how many jobs may be running or waiting for their callback, and bytes, if set, how big they may
+	// be in total. Both are released once a job's callback has run. With WithKeyedOrdering, each stream has a window
+	// of its own instead.
+	window *Semaphore
+	bytes  *Semaphore
+	// windowSize is the size of the window given to WithReorderWindow, or 0 if it follows the parallelization.
+	windowSize      int
+	parallelization int
+	// hedging is set by WithHedging. durations holds the time taken by recent jobs, and nextDuration where the next
+	// one is recorded once durations is full.
+	hedging      *HedgePolicy
+	durations    []time.Duration
+	nextDuration int
+	// wg counts jobs whose callback hasn't run yet.
+	wg sync.WaitGroup
+	// ctx is cancelled when the first job or callback fails.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	// err is the first error returned by a job or callback since the last call to Wait.
+	err   error
+	errMu sync.Mutex
+}
+
+// Stats describes what a Processor is doing, and how much head-of-line blocking it has seen.
+type Stats struct {
+	// Running is the number of jobs running now.
+	Running int
+	// Waiting is the number of completed jobs waiting for an earlier job to complete, and WaitingBytes their size.
+	Waiting      int
+	WaitingBytes int64
+	// MaxWaiting is the most completed jobs which have waited at once.
+	MaxWaiting int
+	// Stalls counts the jobs which completed before an earlier job, and StallTime is the total time they waited.
+	Stalls    int64
+	StallTime time.Duration
+	// WindowWaits counts the times Submit waited because the reorder window or byte budget was full, and
+	// WindowWaitTime is the total time it waited.
+	WindowWaits    int64
+	WindowWaitTime time.Duration
+	// Hedges counts the duplicates started by WithHedging, and HedgeWins those which finished before the original.
+	Hedges    int64
+	HedgeWins int64
+}
+
+// stream is a sequence of jobs whose callbacks run in the order the jobs were submitted.
+type stream struct {
+	key string
+	// nextSeq is the sequence number given to the next job submitted. if a < b, then job(a)'s callback will be
+	// started before job(b)'s.
+	nextSeq int64
+	// nextCallback is the sequence number of the next callback to run.
+	nextCallback int64
+	// pending holds jobs which have completed, until their callback's turn comes.
+	pending reorderBuffer
+	// draining is true while a goroutine is running callbacks. Any other goroutine which completes a job leaves its
+	// callback to it.
+	draining bool
+	// running holds the jobs which are running and may be hedged.
+	running map[int64]hedgeable
+	// window limits how many of the stream's jobs may be running or waiting for their callback.
+	window *Semaphore
+	// outstanding counts the jobs being submitted to the stream or whose callback hasn't run, so that the stream can be
+	// forgotten once it is idle.
+	outstanding int
+}
+
+type Option func(p *Processor)
+
+// WithKeyedOrdering orders callbacks by key, as given to each job with Key, rather than across every job: the
+// callbacks of jobs with the same key run in the order they were submitted, while jobs with different keys proceed
+// independently, and their callbacks may run at the same time. Each key has a reorder window of its own, so a slow job
+// only holds up jobs with the same key, but every key shares the parallelization and byte budget.
+func WithKeyedOrdering() Option {
+	return func(p *Processor) {
+		p.keyed = true
+	}
+}
+
+// WithPriorityLanes lets jobs submitted with Urgent skip ahead of any other jobs waiting for capacity, in the
+// concurrency limit, reorder window and byte budget alike. Callbacks still run in the order jobs were let in.
+func WithPriorityLanes() Option {
+	return func(p *Processor) {
+		p.priority = true
+	}
+}
+
+// WithReorderWindow lets up to n jobs be running or completed and waiting for their callback at once, so that while
+// one job is slow, later jobs can keep running until n in all are outstanding. It defaults to the parallelization,
+// which means a single slow job holds every other job up.
+func WithReorderWindow(n int) Option {
+	return func(p *Processor) {
+		p.windowSize = n
+	}
+}
+
+// WithByteBudget caps the total size, as given to SubmitSized, of the jobs which are running or waiting for their
+// callback. A job bigger than the whole budget runs once nothing else is outstanding. A budget of 0 or less means no
+// budget at all.
+func WithByteBudget(maxBytes int64) Option {
+	return func(p *Processor) {
+		if maxBytes <= 0 {
+			p.bytes = nil
+			return
+		}
+		p.bytes = NewSemaphore(int(maxBytes))
+	}
+}
+
+// New returns a Processor which runs up to parallelization jobs at once.
+func New(parallelization int, options ...Option) *Processor {
+	p := &Processor{
+		streams:         map[string]*stream{},
+		semaphore:       NewSemaphore(parallelization),
+		parallelization: parallelization,
+	}
+	for _, opt := range options {
+		opt(p)
+	}
+	p.window = NewSemaphore(p.windowLimit())
+	p.ctx, p.cancel = context.WithCancelCause(context.Background())
+
+	return p
+}
+
+// Stats returns what the processor is doing now, and the head-of-line blocking it has seen so far.
+func (p *Processor) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// windowLimit returns the size of the reorder window. p.mu must be held, once p is in use.
+func (p *Processor) windowLimit() int {
+	if p.windowSize > 0 {
+		return p.windowSize
+	}
+	return p.parallelization
+}
+
+// join returns the stream of jobs with key, creating it if it has no outstanding jobs, and counts a job being
+// submitted to it.
+func (p *Processor) join(key string) *stream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.keyed {
+		key = ""
+	}
+	s, ok := p.streams[key]
+	if !ok {
+		s = &stream{key: key, running: map[int64]hedgeable{}, window: p.window}
+		if p.keyed {
+			s.window = NewSemaphore(p.windowLimit())
+		}
+		p.streams[key] = s
+	}
+	s.outstanding += 1
+	return s
+}
+
+// leave stops counting a job of stream s, whether its callback has run or it wasn't submitted after all, and forgets
+// the stream once it is idle. p.mu must be held.
+func (p *Processor) leave(s *stream) {
+	s.outstanding -= 1
+	if s.outstanding == 0 && !s.draining {
+		delete(p.streams, s.key)
+	}
+}
+
+// complete records that the job with sequence number seq in stream s has completed, then runs every callback of the
+// stream whose turn has come unless another goroutine is already doing so. Pushing the completion and checking for a
+// drainer under the same lock means no completion can be missed.
+func (p *Processor) complete(s *stream, seq int64, c completion, size int64, elapsed time.Duration, err error,
+	hedgeWon bool) {
+	p.semaphore.Release()
+	p.mu.Lock()
+	p.stats.Running -= 1
+	delete(s.running, seq)
+	if p.hedging != nil && err == nil {
+		p.recordDuration(elapsed)
+	}
+	if hedgeWon {
+		p.stats.HedgeWins += 1
+	}
+	stalled := seq != s.nextCallback
+	p.stats.Waiting += 1
+	if stalled {
+		p.stats.Stalls += 1
+		p.stats.WaitingBytes += size
+		p.stats.MaxWaiting = max(p.stats.MaxWaiting, p.stats.Waiting)
+	}
+	s.pending.Push(sequenced{seq: seq, completion: c, size: size, completedAt: time.Now(), stalled: stalled})
+	if s.draining {
+		p.mu.Unlock()
+		return
+	}
+	s.draining = true
+	for {
+		next, ok := s.pending.Pop(s.nextCallback)
+		if !ok {
+			s.draining = false
+			if s.outstanding == 0 {
+				delete(p.streams, s.key)
+			}
+			p.mu.Unlock()
+			return
+		}
+		p.stats.Waiting -= 1
+		if next.stalled {
+			p.stats.WaitingBytes -= next.size
+			p.stats.StallTime += time.Since(next.completedAt)
+		}
+		p.mu.Unlock()
+
+		// Once something has failed, callbacks are skipped but we still need to account for them.
+		if p.getErr() == nil {
+			if err := next.completion.callback(); err != nil {
+				p.fail(err)
+			}
+		}
+
+		p.mu.Lock()
+		s.nextCallback += 1
+		p.leave(s)
+		s.window.Release()
+		if p.bytes != nil {
+			p.bytes.ReleaseN(int(next.size))
+		}
+		p.wg.Done()
+		if p.hedging != nil {
+			// The new head of the line may already have run past its deadline.
+			p.hedgeHead(s)
+		}
+	}
+}
+
+// Wait blocks until every submitted job and callback has finished, and returns the first error encountered. Once
+// Wait returns, the processor is ready to accept a new batch of jobs.
+func (p *Processor) Wait() error {
+	p.wg.Wait()
+
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	err := p.err
+	if err != nil {
+		p.err = nil
+		p.ctx, p.cancel = context.WithCancelCause(context.Background())
+	}
+	return err
+}
+
+// Stop waits for every submitted job and callback to finish, after which Submit returns ErrStopped.
+func (p *Processor) Stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	_ = p.Wait()
+}
+
+// SetParallelization changes how many jobs may run at once. Jobs which are already running are unaffected. The
+// reorder window follows the parallelization unless it was set with WithReorderWindow.
+func (p *Processor) SetParallelization(parallelization int) {
+	p.semaphore.SetLimit(parallelization)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.parallelization = parallelization
+	if p.windowSize <= 0 {
+		p.window.SetLimit(parallelization)
+		if p.keyed {
+			for _, s := range p.streams {
+				s.window.SetLimit(parallelization)
+			}
+		}
+	}
+}
+
+// Submit schedules job to run on p once there is capacity, and cb to run with its result once job and every job
+// submitted before it, or with WithKeyedOrdering every job with the same key submitted before it, have finished. job
+// is passed a context which is cancelled if ctx is cancelled or if another job or callback fails. An error is returned
+// if the job could not be submitted, in which case neither job nor cb will be run.
+func Submit[T any](ctx context.Context, p *Processor, job func(ctx context.Context) (T, error),
+	cb func(result T) error, options ...JobOption) error {
+	return SubmitSized(ctx, p, 0, job, cb, options...)
+}
+
+// SubmitSized is like Submit, but counts size bytes against the budget given to WithByteBudget until cb has run.
+func SubmitSized[T any](ctx context.Context, p *Processor, size int64, job func(ctx context.Context) (T, error),
+	cb func(result T) error, options ...JobOption) error {
+	config := jobConfig{}
+	for _, opt := range options {
+		opt(&config)
+	}
+	procCtx := p.context()
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(procCtx, func() {
+		cancel(context.Cause(procCtx))
+	})
+	done := func() {
+		stop()
+		cancel(nil)
+	}
+
+	urgent := config.urgent && p.priority
+	s := p.join(config.key)
+	if err := p.reserve(jobCtx, s, size, urgent); err != nil {
+		err = context.Cause(jobCtx)
+		p.abandon(s, size, false)
+		done()
+		return err
+	}
+	if err := p.semaphore.acquire(jobCtx, 1, urgent); err != nil {
+		err = context.Cause(jobCtx)
+		p.abandon(s, size, true)
+		done()
+		return err
+	}
+
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		p.semaphore.Release()
+		p.abandon(s, size, true)
+		done()
+		return ErrStopped
+	}
+	action := &action[T]{
+		seq:     s.nextSeq,
+		stream:  s,
+		size:    size,
+		ctx:     jobCtx,
+		fn:      job,
+		cb:      cb,
+		p:       p,
+		done:    done,
+		started: time.Now(),
+		runs:    1,
+	}
+	hedgeable := config.idempotent && p.hedging != nil
+	if hedgeable {
+		s.running[action.seq] = action
+	}
+	s.nextSeq += 1
+	p.stats.Running += 1
+	p.wg.Add(1)
+	p.mu.Unlock()
+
+	go action.Start(hedgeable)
+
+	return nil
+}
+
+// reserve takes a place in the reorder window of stream s and size bytes of the byte budget for a job, recording how
+// long it had to wait for them.
+func (p *Processor) reserve(ctx context.Context, s *stream, size int64, urgent bool) error {
+	gotWindow := s.window.tryAcquire(1, urgent)
+	if gotWindow && (p.bytes == nil || p.bytes.tryAcquire(int(size), urgent)) {
+		return nil
+	}
+	start := time.Now()
+	var err error
+	if !gotWindow {
+		err = s.window.acquire(ctx, 1, urgent)
+	}
+	if err == nil && p.bytes != nil {
+		if err = p.bytes.acquire(ctx, int(size), urgent); err != nil {
+			s.window.Release()
+		}
+	}
+	p.mu.Lock()
+	p.stats.WindowWaits += 1
+	p.stats.WindowWaitTime += time.Since(start)
+	p.mu.Unlock()
+	return err
+}
+
+// abandon gives up on submitting a job to stream s, giving back what reserve took if it was reserved.
+func (p *Processor) abandon(s *stream, size int64, reserved bool) {
+	if reserved {
+		s.window.Release()
+		if p.bytes != nil {
+			p.bytes.ReleaseN(int(size))
+		}
+	}
+	p.mu.Lock()
+	p.leave(s)
+	p.mu.Unlock()
+}
+
+// Context returns a context which is cancelled, with the error as its cause, once a job or callback fails. Wait
+// collects the failure, after which Context returns a new context.
+func (p *Processor) Context() context.Context {
+	return p.context()
+}
+
+func (p *Processor) context() context.Context {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	return p.ctx
+}
+
+// fail records err if it is the first failure, and cancels all outstanding jobs.
+func (p *Processor) fail(err error) {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	if p.err == nil {
+		p.err = err
+		p.cancel(err)
+	}
+}
+
+func (p *Processor) getErr() error {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	return p.err
+}
+
+// completion is a finished action waiting for its turn to run its callback.
+type completion interface {
+	callback() error
+}
+
+type action[T any] struct {
+	seq     int64
+	stream  *stream
+	size    int64
+	ctx     context.Context
+	fn      func(ctx context.Context) (T, error)
+	cb      func(result T) error
+	p       *Processor
+	done    func()
+	started time.Time
+
+	// mu guards the fields below it, which keep track of the runs of a hedged job.
+	mu       sync.Mutex
+	runs     int
+	hedged   bool
+	finished bool
+	cancels  []context.CancelFunc
+	timer    *time.Timer
+}
+
+func (a *action[T]) Start(hedgeable bool) {
+	if hedgeable {
+		timer := a.p.armHedge(a.stream, a.seq)
+		a.mu.Lock()
+		a.timer = timer
+		a.mu.Unlock()
+	}
+	a.run(0)
+}
+
+// run runs the job. The first run to succeed, or the last to fail, completes the action and cancels the others.
+func (a *action[T]) run(attempt int) {
+	ctx, cancel := context.WithCancel(context.WithValue(a.ctx, attemptKey{}, attempt))
+	defer cancel()
+	a.mu.Lock()
+	a.cancels = append(a.cancels, cancel)
+	a.mu.Unlock()
+
+	result, err := a.fn(ctx)
+
+	a.mu.Lock()
+	a.runs -= 1
+	if a.finished || (err != nil && a.runs > 0) {
+		// Another run finished first, or may yet succeed.
+		a.mu.Unlock()
+		return
+	}
+	a.finished = true
+	for _, cancel := range a.cancels {
+		cancel()
+	}
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	a.mu.Unlock()
+
+	a.done()
+	if err != nil {
+		a.p.fail(err)
+	}
+	a.p.complete(a.stream, a.seq, &finished[T]{cb: a.cb, result: result}, a.size, time.Since(a.started), err,
+		attempt > 0)
+}
+
+func (a *action[T]) startedAt() time.Time {
+	return a.started
+}
+
+// hedge starts a duplicate run of the job, unless it has finished or already been hedged.
+func (a *action[T]) hedge() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.finished || a.hedged {
+		return false
+	}
+	a.hedged = true
+	a.runs += 1
+	go a.run(1)
+	return true
+}
+
+// finished holds the result of an action until its callback can be run.
+type finished[T any] struct {
+	cb     func(result T) error
+	result T
+}
+
+func (f *finished[T]) callback() error {
+	return f.cb(f.result)
+}
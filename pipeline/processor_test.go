@@ -0,0 +1,309 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	TestRuns = 50
+)
+
+func TestSerial(t *testing.T) {
+	p := New(1)
+
+	processed := testProcessor(p)
+
+	assert.Equal(t, TestRuns, processed)
+}
+
+func testProcessor(p *Processor) int {
+	processed := 0
+
+	for i := 0; i < TestRuns; i++ {
+		job := func(ctx context.Context) (int, error) {
+			r := time.Duration(rand.Intn(50))
+			time.Sleep(r * time.Millisecond)
+
+			return i, nil
+		}
+		cb := func(result int) error {
+			if processed != result {
+				return fmt.Errorf("expected %d jobs, got %d", result, processed)
+			}
+			processed += 1
+
+			return nil
+		}
+		_ = Submit(context.Background(), p, job, cb)
+	}
+	_ = p.Wait()
+
+	return processed
+}
+
+func TestParallel(t *testing.T) {
+	p := New(2)
+
+	processed := testProcessor(p)
+
+	assert.Equal(t, TestRuns, processed)
+}
+
+func TestJobErrorCancelsOutstandingJobs(t *testing.T) {
+	p := New(4)
+	jobErr := errors.New("job failed")
+	processed := 0
+	cancelled := atomic.Int32{}
+
+	for i := 0; i < TestRuns; i++ {
+		job := func(ctx context.Context) (struct{}, error) {
+			if i == 2 {
+				return struct{}{}, jobErr
+			}
+			if i > 2 {
+				<-ctx.Done()
+				cancelled.Add(1)
+				return struct{}{}, ctx.Err()
+			}
+			return struct{}{}, nil
+		}
+		cb := func(struct{}) error {
+			processed += 1
+			return nil
+		}
+		if err := Submit(context.Background(), p, job, cb); err != nil {
+			assert.ErrorIs(t, err, jobErr)
+			break
+		}
+	}
+
+	assert.ErrorIs(t, p.Wait(), jobErr)
+	assert.LessOrEqual(t, processed, 2)
+	assert.Greater(t, cancelled.Load(), int32(0))
+}
+
+func TestCallbackErrorStopsCallbacks(t *testing.T) {
+	p := New(2)
+	cbErr := errors.New("callback failed")
+	processed := 0
+
+	for i := 0; i < 10; i++ {
+		job := func(ctx context.Context) (int, error) {
+			return i, nil
+		}
+		cb := func(result int) error {
+			if result == 3 {
+				return cbErr
+			}
+			processed += 1
+			return nil
+		}
+		if err := Submit(context.Background(), p, job, cb); err != nil {
+			break
+		}
+	}
+
+	assert.ErrorIs(t, p.Wait(), cbErr)
+	assert.Equal(t, 3, processed)
+
+	// The processor can be used again once the error has been returned.
+	processed = testProcessor(p)
+	assert.Equal(t, TestRuns, processed)
+}
+
+func TestSubmitContextCancelled(t *testing.T) {
+	p := New(1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	started := make(chan struct{})
+	err := Submit(ctx, p, func(ctx context.Context) (struct{}, error) {
+		close(started)
+		<-ctx.Done()
+		return struct{}{}, ctx.Err()
+	}, func(struct{}) error {
+		return nil
+	})
+	assert.NoError(t, err)
+	<-started
+	cancel()
+
+	err = Submit(ctx, p, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, nil
+	}, func(struct{}) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, p.Wait(), context.Canceled)
+}
+
+func TestSubmitMixedResults(t *testing.T) {
+	p := New(4)
+	results := []string{}
+
+	for i := 0; i < 10; i++ {
+		if i%2 == 0 {
+			_ = Submit(context.Background(), p, func(ctx context.Context) (int, error) {
+				return i, nil
+			}, func(result int) error {
+				results = append(results, fmt.Sprint(result))
+				return nil
+			})
+		} else {
+			_ = Submit(context.Background(), p, func(ctx context.Context) (string, error) {
+				return fmt.Sprintf("job %d", i), nil
+			}, func(result string) error {
+				results = append(results, result)
+				return nil
+			})
+		}
+	}
+
+	assert.NoError(t, p.Wait())
+	assert.Equal(t, []string{"0", "job 1", "2", "job 3", "4", "job 5", "6", "job 7", "8", "job 9"}, results)
+}
+
+// checkGoroutines fails t if more goroutines are left running at the end of the test than were running at the start.
+func checkGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	t.Cleanup(func() {
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		assert.LessOrEqual(t, runtime.NumGoroutine(), before, "goroutines leaked")
+	})
+}
+
+func TestStop(t *testing.T) {
+	checkGoroutines(t)
+	p := New(2)
+	processed := testProcessor(p)
+	assert.Equal(t, TestRuns, processed)
+
+	p.Stop()
+	err := Submit(context.Background(), p, func(ctx context.Context) (int, error) {
+		return 0, nil
+	}, func(int) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrStopped)
+	// Stopping twice is harmless.
+	p.Stop()
+}
+
+func TestStress(t *testing.T) {
+	for _, parallelization := range []int{1, 2, 8, 64} {
+		t.Run(fmt.Sprint(parallelization), func(t *testing.T) {
+			checkGoroutines(t)
+			p := New(parallelization)
+			const jobs = 2000
+			next := 0
+			inCallback := atomic.Int32{}
+			for i := 0; i < jobs; i++ {
+				if i%100 == 0 {
+					// Changing the parallelization mid-flight mustn't upset the ordering.
+					p.SetParallelization(1 + rand.Intn(2*parallelization))
+				}
+				_ = Submit(context.Background(), p, func(ctx context.Context) (int, error) {
+					switch rand.Intn(3) {
+					case 0:
+						runtime.Gosched()
+					case 1:
+						time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+					}
+					return i, nil
+				}, func(result int) error {
+					assert.Equal(t, int32(1), inCallback.Add(1), "callbacks ran concurrently")
+					defer inCallback.Add(-1)
+					assert.Equal(t, next, result)
+					next += 1
+					return nil
+				})
+			}
+			assert.NoError(t, p.Wait())
+			assert.Equal(t, jobs, next)
+			p.Stop()
+		})
+	}
+}
+
+// testCompletionOrder completes one job for each byte of order, in the order given by sorting the bytes, and checks
+// that the callbacks still run in the order the jobs were submitted.
+func testCompletionOrder(t *testing.T, order []byte) {
+	n := min(len(order), 64)
+	p := New(max(n, 1))
+	release := make([]chan struct{}, n)
+	results := []int{}
+	for i := 0; i < n; i++ {
+		release[i] = make(chan struct{})
+		err := Submit(context.Background(), p, func(ctx context.Context) (int, error) {
+			<-release[i]
+			return i, nil
+		}, func(result int) error {
+			results = append(results, result)
+			return nil
+		})
+		assert.NoError(t, err)
+	}
+
+	completion := make([]int, n)
+	for i := range completion {
+		completion[i] = i
+	}
+	sort.SliceStable(completion, func(a, b int) bool {
+		return order[completion[a]] < order[completion[b]]
+	})
+	for _, i := range completion {
+		close(release[i])
+		if order[i]%4 == 0 {
+			// Sometimes let the job complete before releasing the next, rather than all at once.
+			time.Sleep(10 * time.Microsecond)
+		}
+	}
+
+	assert.NoError(t, p.Wait())
+	expected := make([]int, n)
+	for i := range expected {
+		expected[i] = i
+	}
+	assert.Equal(t, expected, results)
+}
+
+func TestCompletionOrder(t *testing.T) {
+	checkGoroutines(t)
+	testCompletionOrder(t, []byte{3, 2, 1, 0})
+	testCompletionOrder(t, []byte{0, 1, 2, 3})
+	testCompletionOrder(t, []byte{9, 0, 4, 4, 1, 8, 0})
+}
+
+func FuzzCompletionOrder(f *testing.F) {
+	f.Add([]byte{3, 2, 1, 0})
+	f.Add([]byte{0, 1, 2, 3, 4, 5, 6, 7})
+	f.Add([]byte{7, 0, 7, 0, 7, 0})
+	f.Fuzz(func(t *testing.T, order []byte) {
+		testCompletionOrder(t, order)
+	})
+}
+
+func BenchmarkSerial(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		p := New(1)
+		testProcessor(p)
+	}
+}
+
+func BenchmarkParallel(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		p := New(2)
+		testProcessor(p)
+	}
+}
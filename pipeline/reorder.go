@@ -0,0 +1,57 @@
+package pipeline
+
+import (
+	"container/heap"
+	"time"
+)
+
+// reorderBuffer holds completed jobs until every job submitted before them has completed too. It is a min-heap keyed
+// by sequence number, so the next job in order is always on top.
+type reorderBuffer []sequenced
+
+// sequenced is a completed job and the order in which it was submitted.
+type sequenced struct {
+	seq         int64
+	completion  completion
+	size        int64
+	completedAt time.Time
+	// stalled is true if the job completed before an earlier job.
+	stalled bool
+}
+
+// Push adds a completed job.
+func (b *reorderBuffer) Push(s sequenced) {
+	heap.Push((*reorderHeap)(b), s)
+}
+
+// Pop removes and returns the completed job with sequence number next, or false if it hasn't completed yet.
+func (b *reorderBuffer) Pop(next int64) (sequenced, bool) {
+	if len(*b) == 0 || (*b)[0].seq != next {
+		return sequenced{}, false
+	}
+	return heap.Pop((*reorderHeap)(b)).(sequenced), true
+}
+
+func (b *reorderBuffer) Len() int {
+	return len(*b)
+}
+
+// reorderHeap implements heap.Interface for reorderBuffer.
+type reorderHeap []sequenced
+
+func (h reorderHeap) Len() int           { return len(h) }
+func (h reorderHeap) Less(i, j int) bool { return h[i].seq < h[j].seq }
+func (h reorderHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *reorderHeap) Push(x any) {
+	*h = append(*h, x.(sequenced))
+}
+
+func (h *reorderHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = sequenced{}
+	*h = old[:n-1]
+	return x
+}
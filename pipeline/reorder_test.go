@@ -0,0 +1,39 @@
+package pipeline
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// seqCompletion is a completion which remembers its sequence number.
+type seqCompletion int64
+
+func (c seqCompletion) callback() error {
+	return nil
+}
+
+func TestReorderBuffer(t *testing.T) {
+	b := reorderBuffer{}
+	for _, seq := range []int64{4, 1, 3, 0} {
+		b.Push(sequenced{seq: seq, completion: seqCompletion(seq)})
+	}
+
+	popped := []completion{}
+	next := int64(0)
+	for s, ok := b.Pop(next); ok; s, ok = b.Pop(next) {
+		popped = append(popped, s.completion)
+		next += 1
+	}
+	// 2 hasn't completed, so 3 and 4 have to wait for it.
+	assert.Equal(t, []completion{seqCompletion(0), seqCompletion(1)}, popped)
+	assert.Equal(t, 2, b.Len())
+
+	b.Push(sequenced{seq: 2, completion: seqCompletion(2)})
+	for _, seq := range []int64{2, 3, 4} {
+		s, ok := b.Pop(seq)
+		assert.True(t, ok)
+		assert.Equal(t, seqCompletion(seq), s.completion)
+	}
+	_, ok := b.Pop(5)
+	assert.False(t, ok)
+}
@@ -0,0 +1,131 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+)
+
+// Semaphore allows up to limit holders at once. Unlike a buffered channel, the limit can be changed while the
+// semaphore is in use.
+type Semaphore struct {
+	mu    sync.Mutex
+	limit int
+	held  int
+	// urgent counts the callers of AcquireUrgentN which are waiting. Nobody else may acquire while there are any.
+	urgent int
+	// freeCh is closed and replaced whenever a slot may have become available.
+	freeCh chan struct{}
+}
+
+func NewSemaphore(n int) *Semaphore {
+	return &Semaphore{limit: n, freeCh: make(chan struct{})}
+}
+
+func (s *Semaphore) Acquire() {
+	_ = s.AcquireContext(context.Background())
+}
+
+// AcquireContext is like Acquire, but gives up and returns an error if ctx is done first.
+func (s *Semaphore) AcquireContext(ctx context.Context) error {
+	return s.AcquireN(ctx, 1)
+}
+
+// AcquireN takes n slots at once, waiting until they are all free or ctx is done. Asking for more slots than the
+// limit succeeds once there are no other holders, rather than waiting forever.
+func (s *Semaphore) AcquireN(ctx context.Context, n int) error {
+	return s.acquire(ctx, n, false)
+}
+
+// AcquireUrgentN is like AcquireN, but goes ahead of every caller of AcquireN which is waiting.
+func (s *Semaphore) AcquireUrgentN(ctx context.Context, n int) error {
+	return s.acquire(ctx, n, true)
+}
+
+func (s *Semaphore) acquire(ctx context.Context, n int, urgent bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.fits(n, urgent) {
+		s.held += n
+		s.mu.Unlock()
+		return nil
+	}
+	if urgent {
+		s.urgent += 1
+	}
+	defer func() {
+		if urgent {
+			s.urgent -= 1
+			// Whoever was held back by this caller may go ahead now.
+			s.notify()
+		}
+		s.mu.Unlock()
+	}()
+	for {
+		freeCh := s.freeCh
+		s.mu.Unlock()
+
+		select {
+		case <-freeCh:
+		case <-ctx.Done():
+			s.mu.Lock()
+			return ctx.Err()
+		}
+
+		s.mu.Lock()
+		if s.fits(n, urgent) {
+			s.held += n
+			return nil
+		}
+	}
+}
+
+// TryAcquireN takes n slots if they are free, without waiting. It returns false if they weren't.
+func (s *Semaphore) TryAcquireN(n int) bool {
+	return s.tryAcquire(n, false)
+}
+
+func (s *Semaphore) tryAcquire(n int, urgent bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.fits(n, urgent) {
+		return false
+	}
+	s.held += n
+	return true
+}
+
+// fits reports whether n more slots can be taken. Unless urgent, they can't while an urgent caller is waiting.
+func (s *Semaphore) fits(n int, urgent bool) bool {
+	if !urgent && s.urgent > 0 {
+		return false
+	}
+	return s.held+n <= s.limit || (s.held == 0 && n > s.limit && s.limit > 0)
+}
+
+func (s *Semaphore) Release() {
+	s.ReleaseN(1)
+}
+
+// ReleaseN gives back n slots taken by AcquireN.
+func (s *Semaphore) ReleaseN(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held -= n
+	s.notify()
+}
+
+// SetLimit changes how many holders are allowed. Lowering the limit doesn't affect existing holders, but new ones
+// will wait until enough have been released.
+func (s *Semaphore) SetLimit(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = n
+	s.notify()
+}
+
+func (s *Semaphore) notify() {
+	close(s.freeCh)
+	s.freeCh = make(chan struct{})
+}
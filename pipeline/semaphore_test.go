@@ -0,0 +1,91 @@
+package pipeline
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSemaphoreSetLimit(t *testing.T) {
+	s := NewSemaphore(1)
+	s.Acquire()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.AcquireContext(ctx), context.DeadlineExceeded)
+
+	// Raising the limit wakes up anyone who is waiting.
+	acquired := make(chan struct{})
+	go func() {
+		s.Acquire()
+		close(acquired)
+	}()
+	s.SetLimit(2)
+	<-acquired
+
+	// Lowering it makes new holders wait until enough have been released.
+	s.SetLimit(1)
+	s.Release()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.AcquireContext(ctx), context.DeadlineExceeded)
+	s.Release()
+	assert.NoError(t, s.AcquireContext(context.Background()))
+}
+
+func TestSemaphoreAcquireN(t *testing.T) {
+	s := NewSemaphore(10)
+	assert.NoError(t, s.AcquireN(context.Background(), 6))
+	assert.False(t, s.TryAcquireN(5))
+	assert.True(t, s.TryAcquireN(4))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.AcquireN(ctx, 1), context.DeadlineExceeded)
+
+	s.ReleaseN(10)
+	// More than the limit is allowed only while there are no other holders.
+	assert.True(t, s.TryAcquireN(15))
+	assert.False(t, s.TryAcquireN(1))
+	s.ReleaseN(15)
+}
+
+func TestSemaphoreAcquireUrgentN(t *testing.T) {
+	s := NewSemaphore(1)
+	s.Acquire()
+
+	normal := make(chan struct{})
+	go func() {
+		s.Acquire()
+		close(normal)
+	}()
+	urgent := make(chan struct{})
+	go func() {
+		assert.NoError(t, s.AcquireUrgentN(context.Background(), 1))
+		close(urgent)
+	}()
+	assert.Eventually(t, func() bool {
+		return waitingUrgent(s) == 1
+	}, time.Second, time.Millisecond)
+	// Nobody else can jump the queue while an urgent caller waits.
+	assert.False(t, s.TryAcquireN(1))
+
+	s.Release()
+	<-urgent
+	select {
+	case <-normal:
+		t.Fatal("normal caller acquired before the urgent one released")
+	default:
+	}
+	s.Release()
+	<-normal
+
+	// An urgent caller which gives up stops holding others back.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.AcquireUrgentN(ctx, 1), context.DeadlineExceeded)
+	assert.Equal(t, 0, waitingUrgent(s))
+	s.Release()
+	assert.True(t, s.TryAcquireN(1))
+}
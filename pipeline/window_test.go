@@ -0,0 +1,135 @@
+package pipeline
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockedJobs submits n jobs to p. Job 0 waits until release is closed, and the rest complete straight away. It
+// returns how many jobs have completed, and the results in the order their callbacks ran.
+func blockedJobs(t *testing.T, p *Processor, n int, size int64, release chan struct{}) (*atomic.Int32, *[]int) {
+	completed := &atomic.Int32{}
+	results := &[]int{}
+	for i := 0; i < n; i++ {
+		err := SubmitSized(context.Background(), p, size, func(ctx context.Context) (int, error) {
+			if i == 0 {
+				<-release
+			}
+			completed.Add(1)
+			return i, nil
+		}, func(result int) error {
+			*results = append(*results, result)
+			return nil
+		})
+		assert.NoError(t, err)
+	}
+	return completed, results
+}
+
+func TestReorderWindow(t *testing.T) {
+	checkGoroutines(t)
+	p := New(2, WithReorderWindow(8))
+	release := make(chan struct{})
+	completed, results := blockedJobs(t, p, 8, 0, release)
+
+	// Only 2 jobs run at once, but the rest of the window keeps going while job 0 is stuck.
+	assert.Eventually(t, func() bool {
+		return completed.Load() == 7
+	}, time.Second, time.Millisecond)
+	stats := p.Stats()
+	assert.Equal(t, 1, stats.Running)
+	assert.Equal(t, 7, stats.Waiting)
+	assert.Equal(t, 7, stats.MaxWaiting)
+
+	// The window is full, so the next job has to wait.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := Submit(ctx, p, func(ctx context.Context) (int, error) {
+		return 0, nil
+	}, func(int) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(release)
+	assert.NoError(t, p.Wait())
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7}, *results)
+	stats = p.Stats()
+	assert.Equal(t, 0, stats.Running)
+	assert.Equal(t, 0, stats.Waiting)
+	assert.Equal(t, int64(7), stats.Stalls)
+	assert.Greater(t, stats.StallTime, 7*20*time.Millisecond)
+	assert.Equal(t, int64(1), stats.WindowWaits)
+	assert.GreaterOrEqual(t, stats.WindowWaitTime, 20*time.Millisecond)
+}
+
+func TestDefaultReorderWindow(t *testing.T) {
+	p := New(2)
+	release := make(chan struct{})
+	completed, _ := blockedJobs(t, p, 2, 0, release)
+	assert.Eventually(t, func() bool {
+		return completed.Load() == 1
+	}, time.Second, time.Millisecond)
+
+	// Without a window, nothing more runs behind a slow job.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := Submit(ctx, p, func(ctx context.Context) (int, error) {
+		return 0, nil
+	}, func(int) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(release)
+	assert.NoError(t, p.Wait())
+}
+
+func TestByteBudget(t *testing.T) {
+	checkGoroutines(t)
+	p := New(4, WithReorderWindow(100), WithByteBudget(10))
+	release := make(chan struct{})
+	completed, results := blockedJobs(t, p, 2, 4, release)
+	assert.Eventually(t, func() bool {
+		return completed.Load() == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int64(4), p.Stats().WaitingBytes)
+
+	// 8 of the 10 bytes are taken.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := SubmitSized(ctx, p, 4, func(ctx context.Context) (int, error) {
+		return 0, nil
+	}, func(int) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(release)
+	assert.NoError(t, p.Wait())
+	assert.Equal(t, []int{0, 1}, *results)
+	assert.Equal(t, int64(0), p.Stats().WaitingBytes)
+
+	// A job bigger than the whole budget still runs once it has the budget to itself.
+	err = SubmitSized(context.Background(), p, 20, func(ctx context.Context) (int, error) {
+		return 0, nil
+	}, func(int) error {
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, p.Wait())
+}
+
+func TestZeroByteBudget(t *testing.T) {
+	checkGoroutines(t)
+	// A budget of 0 is no budget, rather than one which no job fits in.
+	p := New(2, WithByteBudget(0))
+	release := make(chan struct{})
+	close(release)
+	_, results := blockedJobs(t, p, 3, 4, release)
+	assert.NoError(t, p.Wait())
+	assert.Equal(t, []int{0, 1, 2}, *results)
+}